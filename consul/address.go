@@ -0,0 +1,254 @@
+package consul
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// addressType defines which of the addresses of a service instance is
+// resolved.
+type addressType int
+
+const (
+	addressTypeUndefined addressType = iota
+	addressTypeService
+	addressTypeNode
+	addressTypeLAN
+	addressTypeLANIPv4
+	addressTypeLANIPv6
+	addressTypeWAN
+	addressTypeWANIPv4
+	addressTypeWANIPv6
+)
+
+// taggedAddressKeys are the keys of the addresses in
+// [consul.AgentService.TaggedAddresses] and [consul.Node.TaggedAddresses]
+// that are looked up for the addressType.
+var taggedAddressKeys = map[addressType]string{
+	addressTypeLAN:     "lan",
+	addressTypeLANIPv4: "lan_ipv4",
+	addressTypeLANIPv6: "lan_ipv6",
+	addressTypeWAN:     "wan",
+	addressTypeWANIPv4: "wan_ipv4",
+	addressTypeWANIPv6: "wan_ipv6",
+}
+
+func parseAddressType(s string) (addressType, error) {
+	switch strings.ToLower(s) {
+	case "service":
+		return addressTypeService, nil
+	case "node":
+		return addressTypeNode, nil
+	}
+
+	for t, key := range taggedAddressKeys {
+		if strings.EqualFold(s, key) {
+			return t, nil
+		}
+	}
+
+	return addressTypeUndefined, fmt.Errorf("unsupported address parameter value: '%s'", s)
+}
+
+// fallback returns the addressType that is used when an entry has no
+// address of type t.
+func (t addressType) fallback() addressType {
+	switch t {
+	case addressTypeLANIPv4, addressTypeLANIPv6, addressTypeWAN:
+		return addressTypeLAN
+	case addressTypeWANIPv4, addressTypeWANIPv6:
+		return addressTypeWAN
+	case addressTypeLAN:
+		return addressTypeService
+	default:
+		return addressTypeUndefined
+	}
+}
+
+// wan returns the WAN equivalent of t.
+// If t has no WAN equivalent, t is returned.
+func (t addressType) wan() addressType {
+	switch t {
+	case addressTypeService, addressTypeLAN:
+		return addressTypeWAN
+	case addressTypeLANIPv4:
+		return addressTypeWANIPv4
+	case addressTypeLANIPv6:
+		return addressTypeWANIPv6
+	default:
+		return t
+	}
+}
+
+// entryAddress returns the host and port of the address of type t of the
+// service entry.
+// If the entry has no address of type t, the addresses in the fallback chain of
+// t are tried:
+//
+//	lan_ipv4, lan_ipv6 -> lan -> service
+//	wan                -> wan_ipv4, wan_ipv6 -> lan -> service
+//	wan_ipv4, wan_ipv6 -> wan -> lan -> service
+//
+// For the tagged address types (lan, wan, lan_ipv4, ...) the service tagged
+// address is preferred over the node tagged address.
+// The address type service resolves to the service address and falls back to
+// the node address if it is empty.
+// If no address is found, e.g. because the entry has no node, an empty host
+// is returned.
+// If the address has no port, the service port is used.
+// fromNode is true if the address is the node address or a node tagged
+// address.
+// log receives a debug message when the node address is used.
+func entryAddress(log *slog.Logger, e *consul.ServiceEntry, t addressType) (host string, port int, fromNode bool) {
+	for ; t != addressTypeUndefined; t = t.fallback() {
+		switch t {
+		case addressTypeService:
+			if e.Service.Address != "" {
+				return e.Service.Address, e.Service.Port, false
+			}
+
+			if e.Node == nil {
+				return "", e.Service.Port, false
+			}
+
+			log.Debug("instance has no ServiceAddress, using agent address",
+				"instance", e.Service.ID,
+				"addr", e.Node.Address,
+			)
+
+			return e.Node.Address, e.Service.Port, true
+
+		case addressTypeNode:
+			if e.Node == nil {
+				return "", e.Service.Port, false
+			}
+
+			return e.Node.Address, e.Service.Port, true
+
+		default:
+			if host, port, fromNode, exists := taggedAddress(e, t); exists {
+				return host, port, fromNode
+			}
+
+			if t != addressTypeWAN {
+				continue
+			}
+
+			for _, st := range t.dualStack() {
+				if host, port, fromNode, exists := taggedAddress(e, st); exists {
+					return host, port, fromNode
+				}
+			}
+		}
+	}
+
+	return "", e.Service.Port, false
+}
+
+// taggedAddress returns the service or node tagged address of type t of the
+// service entry, the service tagged address is preferred. fromNode is true
+// if the node tagged address is returned.
+// If the address has no port, the service port is used.
+func taggedAddress(e *consul.ServiceEntry, t addressType) (host string, port int, fromNode, exists bool) {
+	key := taggedAddressKeys[t]
+
+	if a, exists := e.Service.TaggedAddresses[key]; exists && a.Address != "" {
+		if a.Port == 0 {
+			return a.Address, e.Service.Port, false, true
+		}
+
+		return a.Address, a.Port, false, true
+	}
+
+	if e.Node == nil {
+		return "", 0, false, false
+	}
+
+	if a := e.Node.TaggedAddresses[key]; a != "" {
+		return a, e.Service.Port, true, true
+	}
+
+	return "", 0, false, false
+}
+
+// dualStack returns the IPv4 and IPv6 tagged address types of the network
+// that t belongs to.
+func (t addressType) dualStack() []addressType {
+	switch t {
+	case addressTypeWAN, addressTypeWANIPv4, addressTypeWANIPv6:
+		return []addressType{addressTypeWANIPv4, addressTypeWANIPv6}
+	default:
+		return []addressType{addressTypeLANIPv4, addressTypeLANIPv6}
+	}
+}
+
+// hostPort is a network address of a service instance.
+type hostPort struct {
+	host string
+	port int
+}
+
+// entryAddresses returns all addresses of the service entry under which the
+// instance is reachable in the network of address type t.
+// The first element is the address returned by entryAddress(), it is
+// followed by the IPv4 and IPv6 tagged addresses of the network, if they
+// exist and differ from it. Node tagged addresses are only added if the first
+// address is a node address, an instance with its own service address is
+// not necessarily reachable via the addresses of its node.
+// If the entry has no address, the result is empty.
+func entryAddresses(log *slog.Logger, e *consul.ServiceEntry, t addressType) []hostPort {
+	host, port, primaryFromNode := entryAddress(log, e, t)
+	if host == "" {
+		return nil
+	}
+
+	result := []hostPort{{host: host, port: port}}
+
+	for _, st := range t.dualStack() {
+		host, port, fromNode, exists := taggedAddress(e, st)
+		if !exists || (fromNode && !primaryFromNode) {
+			continue
+		}
+
+		addr := hostPort{host: host, port: port}
+		if !slices.Contains(result, addr) {
+			result = append(result, addr)
+		}
+	}
+
+	return result
+}
+
+// metaPort returns the port that is stored in the service metadata of e with
+// the given key.
+func metaPort(e *consul.ServiceEntry, key string) (int, error) {
+	val, exists := e.Service.Meta[key]
+	if !exists {
+		return 0, fmt.Errorf("service metadata key '%s' does not exist", key)
+	}
+
+	port, err := parsePort(val)
+	if err != nil {
+		return 0, fmt.Errorf("service metadata key '%s' contains an invalid port: %w", key, err)
+	}
+
+	return port, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d is out of range", port)
+	}
+
+	return port, nil
+}
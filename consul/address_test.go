@@ -0,0 +1,179 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func TestEntryAddress(t *testing.T) {
+	tagged := &consul.ServiceEntry{
+		Node: &consul.Node{
+			Address: "10.0.0.1",
+			TaggedAddresses: map[string]string{
+				"lan":      "10.0.0.1",
+				"lan_ipv4": "10.0.0.1",
+				"lan_ipv6": "fd00::1",
+				"wan":      "203.0.113.1",
+				"wan_ipv4": "203.0.113.1",
+			},
+		},
+		Service: &consul.AgentService{
+			Address: "10.0.1.1",
+			Port:    8080,
+			TaggedAddresses: map[string]consul.ServiceAddress{
+				"lan": {Address: "10.0.1.1", Port: 8080},
+				"wan": {Address: "203.0.113.100", Port: 443},
+			},
+		},
+	}
+
+	untagged := &consul.ServiceEntry{
+		Node: &consul.Node{
+			Address: "10.0.0.2",
+		},
+		Service: &consul.AgentService{
+			Port: 8080,
+		},
+	}
+
+	noNode := &consul.ServiceEntry{
+		Service: &consul.AgentService{
+			Port: 8080,
+			TaggedAddresses: map[string]consul.ServiceAddress{
+				"wan": {Address: "203.0.113.100", Port: 443},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		entry    *consul.ServiceEntry
+		addrType string
+		want     string
+	}{
+		{"tagged", tagged, "service", "10.0.1.1:8080"},
+		{"tagged", tagged, "node", "10.0.0.1:8080"},
+		{"tagged", tagged, "lan", "10.0.1.1:8080"},
+		{"tagged", tagged, "lan_ipv4", "10.0.0.1:8080"},
+		{"tagged", tagged, "lan_ipv6", "[fd00::1]:8080"},
+		{"tagged", tagged, "wan", "203.0.113.100:443"},
+		{"tagged", tagged, "wan_ipv4", "203.0.113.1:8080"},
+		// no wan_ipv6 address, falls back to the service tagged wan
+		// address
+		{"tagged", tagged, "wan_ipv6", "203.0.113.100:443"},
+
+		{"untagged", untagged, "service", "10.0.0.2:8080"},
+		{"untagged", untagged, "node", "10.0.0.2:8080"},
+		{"untagged", untagged, "lan", "10.0.0.2:8080"},
+		{"untagged", untagged, "lan_ipv6", "10.0.0.2:8080"},
+		{"untagged", untagged, "wan", "10.0.0.2:8080"},
+		{"untagged", untagged, "wan_ipv4", "10.0.0.2:8080"},
+
+		{"noNode", noNode, "service", ""},
+		{"noNode", noNode, "node", ""},
+		{"noNode", noNode, "lan", ""},
+		{"noNode", noNode, "wan", "203.0.113.100:443"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"-"+tt.addrType, func(t *testing.T) {
+			addrType, err := parseAddressType(tt.addrType)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			host, port, _ := entryAddress(testLogger, tt.entry, addrType)
+			if host == "" {
+				if tt.want != "" {
+					t.Errorf("entryAddress() returned no host, expected: %s", tt.want)
+				}
+
+				return
+			}
+
+			if got := net.JoinHostPort(host, fmt.Sprint(port)); got != tt.want {
+				t.Errorf("entryAddress() returned %s, expected: %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAddressTypeUnsupportedValue(t *testing.T) {
+	if _, err := parseAddressType("public"); err == nil {
+		t.Error("parseAddressType(\"public\") succeeded, expected an error")
+	}
+}
+
+func TestEntryAddresses(t *testing.T) {
+	dualStack := &consul.ServiceEntry{
+		Node: &consul.Node{
+			Address: "10.0.0.1",
+			TaggedAddresses: map[string]string{
+				"lan_ipv4": "10.0.0.1",
+				"lan_ipv6": "fd00::1",
+				"wan_ipv4": "203.0.113.1",
+				"wan_ipv6": "2001:db8::1",
+			},
+		},
+		Service: &consul.AgentService{
+			Port: 8080,
+			TaggedAddresses: map[string]consul.ServiceAddress{
+				"wan_ipv6": {Address: "2001:db8::100", Port: 443},
+			},
+		},
+	}
+
+	tests := []struct {
+		addrType string
+		want     []hostPort
+	}{
+		{"service", []hostPort{{"10.0.0.1", 8080}, {"fd00::1", 8080}}},
+		{"lan_ipv6", []hostPort{{"fd00::1", 8080}, {"10.0.0.1", 8080}}},
+		{"wan", []hostPort{{"203.0.113.1", 8080}, {"2001:db8::100", 443}}},
+		{"wan_ipv4", []hostPort{{"203.0.113.1", 8080}, {"2001:db8::100", 443}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addrType, func(t *testing.T) {
+			addrType, err := parseAddressType(tt.addrType)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := entryAddresses(testLogger, dualStack, addrType); !slices.Equal(got, tt.want) {
+				t.Errorf("entryAddresses() returned %+v, expected: %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEntryAddressesOfServiceWithAddress(t *testing.T) {
+	e := &consul.ServiceEntry{
+		Node: &consul.Node{
+			Address: "10.0.0.1",
+			TaggedAddresses: map[string]string{
+				"lan_ipv4": "10.0.0.1",
+				"lan_ipv6": "fd00::1",
+			},
+		},
+		Service: &consul.AgentService{
+			Address: "10.0.1.1",
+			Port:    8080,
+			TaggedAddresses: map[string]consul.ServiceAddress{
+				"lan_ipv6": {Address: "fd00::100"},
+			},
+		},
+	}
+
+	// the node tagged addresses are not added, the service is not
+	// listening on them
+	want := []hostPort{{"10.0.1.1", 8080}, {"fd00::100", 8080}}
+
+	if got := entryAddresses(testLogger, e, addressTypeService); !slices.Equal(got, want) {
+		t.Errorf("entryAddresses() returned %+v, expected: %+v", got, want)
+	}
+}
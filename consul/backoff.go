@@ -3,6 +3,8 @@ package consul
 import (
 	"math/rand"
 	"time"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/clock"
 )
 
 type backoff struct {
@@ -11,7 +13,9 @@ type backoff struct {
 	jitterSrc *rand.Rand
 }
 
-func defaultBackoff() *backoff {
+// defaultBackoff returns a backoff whose jitter source is seeded with the
+// current time of clk.
+func defaultBackoff(clk clock.Clock) *backoff {
 	return &backoff{
 		intervals: []time.Duration{
 			10 * time.Millisecond,
@@ -26,7 +30,7 @@ func defaultBackoff() *backoff {
 		},
 
 		jitterPct: 10,
-		jitterSrc: rand.New(rand.NewSource(time.Now().UnixNano())),
+		jitterSrc: rand.New(rand.NewSource(clk.Now().UnixNano())),
 	}
 }
 
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"testing"
 	"time"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/clock"
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
 )
 
 func minBackoff(t time.Duration, jitterPCT int) time.Duration {
@@ -15,7 +18,7 @@ func maxBackoff(t time.Duration, jitterPCT int) time.Duration {
 }
 
 func TestBackoff_IntervalIdxBounds(t *testing.T) {
-	b := defaultBackoff()
+	b := defaultBackoff(clock.Real{})
 
 	for i := range []int{-100000, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 99999999} {
 		t.Run(fmt.Sprintf("retry-%d", i), func(t *testing.T) {
@@ -34,3 +37,15 @@ func TestBackoff_IntervalIdxBounds(t *testing.T) {
 		})
 	}
 }
+
+func TestBackoffIsDeterministicWithSameClock(t *testing.T) {
+	clk := mocks.NewClock()
+	b1 := defaultBackoff(clk)
+	b2 := defaultBackoff(clk)
+
+	for i := range 20 {
+		if d1, d2 := b1.Backoff(i), b2.Backoff(i); d1 != d2 {
+			t.Fatalf("backoff %d differs between backoffs seeded with the same clock: %s != %s", i, d1, d2)
+		}
+	}
+}
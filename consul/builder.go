@@ -9,20 +9,170 @@
 // Afterwards it can be used by calling [google.golang.org/grpc.Dial] and
 // passing a URL in the following format:
 //
-//	consul://[<consul-server>]/<serviceName>[?<OPT>[&<OPT>]...]
+//	consul://[<consul-server>]/<serviceName>[,<serviceName>]...[?<OPT>[&<OPT>]...]
+//
+// If multiple service names are specified, a blocking query is run for each
+// of them and the target resolves to the union of their addresses.
+// If querying one of the services fails, the target resolves to the addresses
+// of the remaining services. An error is only reported when none of the
+// services could be resolved.
+//
+// Each service instance is reported as one [resolver.Endpoint]. Its first
+// address is the one selected via the address OPT, it is followed by the IPv4
+// and IPv6 tagged addresses of the instance in the same network (LAN or WAN).
+// Node tagged addresses are only added when the first address is a node
+// address. [resolver.State.Addresses] contains the first address of each endpoint.
 //
 // OPT is one of:
 //
 //   - scheme=http|https specifies if the connection to Consul is established
 //     via HTTP or HTTPS.
-//   - tags=<tag>[,<tag>]... only resolves to instances that have the given
-//     tags. Default: empty
+//   - tags=<tag>[,<tag>]... only resolves to instances that have all of the
+//     given tags. Default: empty
+//   - anyTags=<tag>[,<tag>]... only resolves to instances that have at least
+//     one of the given tags. Default: empty
+//   - excludeTags=<tag>[,<tag>]... only resolves to instances that have none
+//     of the given tags. anyTags and excludeTags are evaluated by the resolver
+//     on the instances returned by Consul, in addition to the tags filter.
+//     Default: empty
 //   - health=healthy|fallbackToUnhealthy filters Services by their health status.
 //     If set to "healthy", the service is only resolved to instances with
 //     passing health checks. If set to "fallbackToUnhealthy", the service
 //     resolves to all instances, if none with a passing status is available.
 //     Default: healthy
 //   - token=<string> includes the token in API-Requests to Consul.
+//   - address=service|node|lan|lan_ipv4|lan_ipv6|wan|wan_ipv4|wan_ipv6
+//     selects which address of an instance is resolved.
+//     "service" resolves to the service address or to the node address if
+//     the service has none. "node" resolves to the node address.
+//     The other values resolve to the service or node tagged address with the
+//     key, the service tagged address is preferred. If an instance has no
+//     such tagged address, the following fallback chain is used:
+//     lan_ipv4, lan_ipv6 -> lan -> service;
+//     wan -> wan_ipv4, wan_ipv6 -> lan -> service;
+//     wan_ipv4, wan_ipv6 -> wan -> lan -> service.
+//     The port of a service tagged address is used if it is set, otherwise
+//     the service port. Instances without any address are ignored.
+//     Default: service
+//   - dc=<datacenter> resolves the services in the given datacenter.
+//     Default: datacenter of the Consul agent
+//   - translateWAN=true|false if enabled and the services are resolved in
+//     a datacenter that differs from the one of the Consul agent, the WAN
+//     addresses of the instances are resolved, like Consul's
+//     translate_wan_addrs setting does for DNS queries.
+//     The address option is translated to its WAN equivalent: service and
+//     lan resolve to wan, lan_ipv4 to wan_ipv4 and lan_ipv6 to wan_ipv6.
+//     The agent datacenter is retrieved via the /v1/agent/self endpoint.
+//     Default: true
+//   - portMeta=<key> resolves to the port that is stored in the service
+//     metadata of an instance with the given key, instead of the service
+//     port. Instances without a valid port in the metadata key are ignored.
+//     Default: empty
+//   - port=<port> resolves to the given port for all instances, instead of
+//     the service port. It can not be combined with portMeta.
+//     Default: empty
+//   - serviceConfigKey=<kv-path> watches the Consul KV key for a
+//     [gRPC service config] in JSON format and reports it together with
+//     the addresses. The conventional key for a service config is
+//     grpc/service-config/<serviceName>. If the value of the key is not a
+//     valid service config, the previous valid config is kept. If the key
+//     does not exist, no service config is reported.
+//     Default: empty
+//   - serviceConfigFromConfigEntries=true|false generates the gRPC service
+//     config from the service-resolver and service-router Consul config
+//     entries of the service and reports it together with the addresses.
+//     The config entries are monitored with blocking queries.
+//     The service-resolver LoadBalancer policies round_robin and
+//     least_request, the service-resolver RequestTimeout, and the
+//     RequestTimeout and retry settings of service-router routes that match
+//     gRPC services or methods via PathExact or PathPrefix are translated.
+//     Other settings are ignored. service-defaults config entries are not
+//     watched, their settings have no equivalent in the gRPC service
+//     config. The option can not be combined with serviceConfigKey and is
+//     only supported for a single service.
+//     Default: false
+//   - subset=[<name>] only resolves to instances that are part of the subset
+//     with the given name in the service-resolver Consul config entry of the
+//     service. The Filter expression of the subset is passed to the health
+//     query, if OnlyPassing is set for the subset, only instances with
+//     passing health checks are resolved. If the name is empty, the
+//     DefaultSubset of the config entry is used, if it has none, all
+//     instances are resolved. The config entry is monitored with a blocking
+//     query, when the subset definition changes the instances are resolved
+//     again. If the config entry or the subset does not exist, an error is
+//     reported for the service.
+//     Default: empty
+//   - regionMeta=<key>, zoneMeta=<key> resolve the locality of the instances
+//     from the service metadata keys, or the node metadata keys if the
+//     service metadata does not contain them. The [Locality] is stored in the
+//     BalancerAttributes of the addresses and the Attributes of the
+//     endpoints, it can be retrieved via [LocalityFromAddress]. The locality
+//     of the client, set via [WithLocality] or read from the node metadata of
+//     the Consul agent, is stored in the Attributes of the resolver state and
+//     can be retrieved via [LocalityFromState].
+//     Default: empty
+//   - subsetSize=<n> only reports up to n instances. The subset is selected
+//     via rendezvous hashing with the ID of the client, set via
+//     [WithClientID] or the hostname by default. Clients with different IDs
+//     select evenly distributed subsets of the instances. When instances
+//     are added or removed, the subset of a client changes by at most one
+//     instance per change. It limits the number of connections of clients
+//     and servers for services with many instances.
+//     Default: empty, all instances are reported
+//   - transport=http|dns specifies how the instances are retrieved from
+//     Consul. "http" uses blocking queries of the HTTP API, "dns" queries the
+//     SRV records [<tag>.]<serviceName>.service[.<dc>].consul from the Consul
+//     DNS interface. With "dns", consul-server is the address of the DNS
+//     server (default: 127.0.0.1:8600) and the records are queried again
+//     after their TTL expired, every 5s if it is 0. Consul DNS only returns
+//     instances that are not critical. The options tags with more than one
+//     tag, anyTags, excludeTags, health=fallbackToUnhealthy, address,
+//     portMeta, serviceConfigKey, serviceConfigFromConfigEntries, subset,
+//     regionMeta and zoneMeta are not supported with "dns", translateWAN is
+//     ignored.
+//     Default: http
+//   - onError=reportError|keepLastState defines how failed Consul queries
+//     are handled. "reportError" discards the addresses of a service when
+//     querying it fails, if none of the services can be resolved the error
+//     is reported to the ClientConn, which can cause it to fail RPCs.
+//     "keepLastState" keeps the last resolved addresses of the service until
+//     its queries fail for longer than errorGracePeriod, then they are
+//     discarded like with "reportError".
+//     Default: reportError or the policy set via [WithErrorPolicy]
+//   - errorGracePeriod=<duration> the duration in the format of
+//     [time.ParseDuration] for that the last addresses are kept with
+//     onError=keepLastState.
+//     Default: 5m or the grace period set via [WithErrorPolicy]
+//   - maxShrink=<pct> protects against mass deregistrations. When a
+//     query result removes more than pct percent (1-99) of the current
+//     instances of a service, the current instances are kept for
+//     maxShrinkWindow. When the instances recover within the window, the
+//     result is discarded, otherwise it is applied afterwards. A result
+//     without instances is applied earlier, when it was returned by 3
+//     consecutive queries.
+//     Default: disabled
+//   - maxShrinkWindow=<duration> the duration in the format of
+//     [time.ParseDuration] for that a result that exceeds maxShrink is held
+//     back.
+//     Default: 2m
+//   - debounce=<duration> coalesces rapid changes, e.g. during rolling
+//     deployments. A changed state is only reported after no further
+//     change happened for the duration, in the format of
+//     [time.ParseDuration]. The first state and the first state after an
+//     error are reported immediately, errors are never delayed.
+//     Default: disabled
+//   - debounceMaxDelay=<duration> the maximum duration for that a changed
+//     state is delayed with debounce.
+//     Default: 5 times the debounce duration
+//   - initialResolveTimeout=<duration> the duration in the format of
+//     [time.ParseDuration] within that addresses must be retrieved from
+//     Consul after the resolver was built. Otherwise an error that wraps
+//     [ErrInitialResolveTimeout] is reported to the ClientConn, it
+//     describes per service if the query failed, returned no instances
+//     ([ErrNoInstances]) or did not complete. Until addresses are
+//     retrieved, empty results and query errors are reported as this
+//     error. Addresses from the cache do not count as retrieved.
+//     Default: disabled
 //
 // If an OPT is defined multiple times, only the value of the last occurrence
 // is used.
@@ -37,28 +187,278 @@
 // used.
 //
 // [Blocking Consul queries]: https://developer.hashicorp.com/consul/api-docs/features/blocking
+// [gRPC service config]: https://github.com/grpc/grpc/blob/master/doc/service_config.md
 // [Consul Environment Variables]: https://developer.hashicorp.com/consul/commands#environment-variables
 package consul
 
 import (
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/clock"
 )
 
-type resolverBuilder struct{}
+// Builder creates consul resolvers, it implements [resolver.Builder].
+// It keeps track of the resolvers it created that were not closed, see
+// [Builder.Snapshot].
+type Builder struct {
+	locality    Locality
+	clientID    string
+	cacheDir    string
+	cacheMaxAge time.Duration
+
+	errorPolicy      ErrorPolicy
+	errorGracePeriod time.Duration
+
+	clock          clock.Clock
+	metrics        Metrics
+	tracerProvider trace.TracerProvider
+	eventHandler   func(Event)
+	logger         *slog.Logger
+
+	// resolversMutex protects resolvers, the resolvers that were built
+	// and not closed yet.
+	resolversMutex sync.Mutex
+	resolvers      map[*consulResolver]struct{}
+}
+
+// defaultCacheMaxAge is the age after that cached addresses are ignored.
+const defaultCacheMaxAge = 24 * time.Hour
 
 const scheme = "consul"
 
+// Option configures the resolvers created by a builder.
+type Option func(*Builder)
+
+// WithLocality sets the locality of the client.
+// It is reported to the load balancer when the regionMeta or zoneMeta OPT is
+// set. If it is not set, the locality of the client is read from the node
+// metadata of the Consul agent.
+func WithLocality(l Locality) Option {
+	return func(b *Builder) {
+		b.locality = l
+	}
+}
+
+// WithClientID sets the ID of the client that is used to select the subset
+// of instances when the subsetSize OPT is set.
+// Clients with different IDs select different subsets. The default is the
+// hostname.
+func WithClientID(id string) Option {
+	return func(b *Builder) {
+		b.clientID = id
+	}
+}
+
+// WithCacheDir enables the on-disk cache of the last successfully resolved
+// addresses.
+// The addresses and the service config of each target are stored in a file in
+// dir. When a resolver is built, the cached addresses of its target are
+// reported immediately. They are replaced as soon as the first query to Consul
+// succeeds. While they are used, errors from Consul are not reported.
+// This allows clients to connect when they are started while Consul is
+// unreachable.
+func WithCacheDir(dir string) Option {
+	return func(b *Builder) {
+		b.cacheDir = dir
+	}
+}
+
+// WithCacheMaxAge sets the age after that cached addresses are ignored.
+// The default is 24h.
+func WithCacheMaxAge(age time.Duration) Option {
+	return func(b *Builder) {
+		b.cacheMaxAge = age
+	}
+}
+
+// WithErrorPolicy sets the [ErrorPolicy] and its grace period that are used
+// when the onError and errorGracePeriod OPTs are not specified in the target
+// URL.
+// If gracePeriod is not positive, the default of 5m is used.
+// The default policy is [ErrorPolicyReportError].
+func WithErrorPolicy(p ErrorPolicy, gracePeriod time.Duration) Option {
+	return func(b *Builder) {
+		b.errorPolicy = p
+
+		b.errorGracePeriod = gracePeriod
+		if gracePeriod <= 0 {
+			b.errorGracePeriod = defaultErrorGracePeriod
+		}
+	}
+}
+
+// WithMetrics sets the implementation that records metrics about the
+// activity of the resolvers, see [Metrics].
+// By default no metrics are recorded.
+func WithMetrics(m Metrics) Option {
+	return func(b *Builder) {
+		b.metrics = m
+	}
+}
+
+// WithTracerProvider enables OpenTelemetry tracing of Consul queries.
+// A span is recorded for each query of the instances of a service, with an
+// event when the resulting addresses are reported to gRPC. Debounced updates
+// are reported after the span ended, they have no event. The trace context
+// is propagated to Consul in W3C Trace Context HTTP headers.
+// By default no spans are recorded.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(b *Builder) {
+		b.tracerProvider = tp
+	}
+}
+
+// WithEventHandler registers a handler that receives the events of the
+// resolvers, see [Event].
+// The events of a resolver are passed in order to the handler from a
+// separate goroutine, a slow handler does not delay the resolution. Up to
+// 1024 events are queued, further events are dropped until the handler
+// caught up. Events that were not passed to the handler when the resolver is
+// closed are discarded, Close waits until a running call of the handler
+// returned.
+func WithEventHandler(h func(Event)) Option {
+	return func(b *Builder) {
+		b.eventHandler = h
+	}
+}
+
+// WithLogger sets the logger that the resolvers write their log messages to.
+// The records have structured attributes like target, service, dc,
+// wait_index, addr_count, retry_in and error. Changes of the resolved
+// addresses are logged on Info level as the added and removed addresses,
+// the complete list of addresses is only logged on Debug level.
+// By default the messages are written to the grpclog component
+// "grpcconsulresolver".
+func WithLogger(l *slog.Logger) Option {
+	return func(b *Builder) {
+		b.logger = l
+	}
+}
+
+// withClock sets the clock that is used for timers, backoffs and timeouts.
+// It is used in tests to control the passing of time.
+func withClock(clk clock.Clock) Option {
+	return func(b *Builder) {
+		b.clock = clk
+	}
+}
+
 // NewBuilder returns a builder for a consul resolver.
-func NewBuilder() resolver.Builder {
-	return &resolverBuilder{}
+func NewBuilder(opts ...Option) *Builder {
+	b := Builder{
+		clock:            clock.Real{},
+		metrics:          noopMetrics{},
+		cacheMaxAge:      defaultCacheMaxAge,
+		errorPolicy:      ErrorPolicyReportError,
+		errorGracePeriod: defaultErrorGracePeriod,
+		resolvers:        map[*consulResolver]struct{}{},
+	}
+	for _, opt := range opts {
+		opt(&b)
+	}
+
+	return &b
 }
 
-func extractOpts(opts url.Values) (scheme string, tags []string, health healthFilter, token string, err error) {
+// resolverOpts are the settings of a resolver that are parsed from the target
+// URL and the builder options.
+type resolverOpts struct {
+	services    []string
+	scheme      string
+	tags        []string
+	anyTags     []string
+	excludeTags []string
+	health      healthFilter
+	token       string
+	address     addressType
+	datacenter  string
+	// translateWAN is true when addresses of instances in remote
+	// datacenters are translated to their WAN address.
+	translateWAN bool
+	// port overwrites the port of all instances if it is not 0.
+	port int
+	// portMeta is the service metadata key that contains the port of an
+	// instance.
+	portMeta string
+	// serviceConfigKey is the Consul KV key that contains the gRPC service
+	// config.
+	serviceConfigKey string
+	// serviceConfigFromConfigEntries is true when the gRPC service config
+	// is generated from the Consul config entries of the service.
+	serviceConfigFromConfigEntries bool
+	// useSubset is true when the instances are filtered by a subset
+	// that is defined in the service-resolver config entry of the
+	// service. subset is the name of the subset, if it is empty the
+	// default subset of the config entry is used.
+	useSubset bool
+	subset    string
+	// regionMeta and zoneMeta are the service and node metadata keys
+	// that contain the locality of an instance.
+	regionMeta string
+	zoneMeta   string
+	// clientLocality is the locality of the client that was passed to
+	// the builder.
+	clientLocality Locality
+	// subsetSize is the maximum number of endpoints that are reported,
+	// 0 means all. clientID is the ID that selects the subset.
+	subsetSize int
+	clientID   string
+	transport  transport
+	// target is the URL of the resolver target.
+	target string
+	// cacheDir is the directory of the endpoint cache, it is disabled if
+	// it is empty. Cache files older than cacheMaxAge are ignored.
+	cacheDir    string
+	cacheMaxAge time.Duration
+	// errorPolicy and errorGracePeriod define how failed queries are
+	// handled, they are set to the builder defaults if they are not
+	// specified in the URL.
+	errorPolicy      ErrorPolicy
+	errorGracePeriod time.Duration
+	// maxShrink is the maximum percentage of the instances of a service
+	// that can be removed by one result, 0 disables the protection.
+	// Results that remove more are held back for maxShrinkWindow.
+	maxShrink       int
+	maxShrinkWindow time.Duration
+	// debounce is the quiet period that must pass without further
+	// changes before an update is reported, 0 disables debouncing.
+	// Updates are delayed at most for debounceMaxDelay.
+	debounce         time.Duration
+	debounceMaxDelay time.Duration
+	// initialResolveTimeout is the duration within that addresses must
+	// be retrieved from Consul, 0 disables the timeout.
+	initialResolveTimeout time.Duration
+	// clock provides the time for timers, backoffs and timeouts.
+	clock clock.Clock
+	// metrics records the activity of the resolver.
+	metrics Metrics
+	// tracerProvider provides the tracer for the spans of Consul
+	// queries, if it is nil no spans are recorded.
+	tracerProvider trace.TracerProvider
+	// eventHandler receives the events of the resolver, it can be nil.
+	eventHandler func(Event)
+	// logger receives the log messages of the resolver, if it is nil
+	// they are written to grpclog.
+	logger *slog.Logger
+}
+
+// localityEnabled returns true if the locality of instances is resolved.
+func (o *resolverOpts) localityEnabled() bool {
+	return o.regionMeta != "" || o.zoneMeta != ""
+}
+
+func extractOpts(opts url.Values, result *resolverOpts) error {
 	for key, values := range opts {
 		if len(values) == 0 {
 			continue
@@ -67,73 +467,338 @@ func extractOpts(opts url.Values) (scheme string, tags []string, health healthFi
 
 		switch strings.ToLower(key) {
 		case "scheme":
-			scheme = strings.ToLower(value)
-			if scheme != "http" && scheme != "https" {
-				return "", nil, healthFilterUndefined, "", fmt.Errorf("unsupported scheme '%s'", value)
+			result.scheme = strings.ToLower(value)
+			if result.scheme != "http" && result.scheme != "https" {
+				return fmt.Errorf("unsupported scheme '%s'", value)
 			}
 
 		case "tags":
-			tags = strings.Split(value, ",")
+			result.tags = strings.Split(value, ",")
+
+		case "anytags":
+			result.anyTags = strings.Split(value, ",")
+
+		case "excludetags":
+			result.excludeTags = strings.Split(value, ",")
 
 		case "health":
 			switch strings.ToLower(value) {
 			case "healthy":
-				health = healthFilterOnlyHealthy
+				result.health = healthFilterOnlyHealthy
 			case "fallbacktounhealthy":
-				health = healthFilterFallbackToUnhealthy
+				result.health = healthFilterFallbackToUnhealthy
 			default:
-				return "", nil, healthFilterUndefined, "", fmt.Errorf("unsupported health parameter value: '%s'", value)
+				return fmt.Errorf("unsupported health parameter value: '%s'", value)
 			}
 		case "token":
-			token = value
+			result.token = value
+
+		case "address":
+			var err error
+
+			result.address, err = parseAddressType(value)
+			if err != nil {
+				return err
+			}
+
+		case "dc":
+			result.datacenter = value
+
+		case "translatewan":
+			var err error
+
+			result.translateWAN, err = strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("unsupported translateWAN parameter value: '%s'", value)
+			}
+
+		case "port":
+			var err error
+
+			result.port, err = parsePort(value)
+			if err != nil {
+				return fmt.Errorf("unsupported port parameter value: '%s': %w", value, err)
+			}
+
+		case "portmeta":
+			if value == "" {
+				return errors.New("portMeta parameter value is empty")
+			}
+
+			result.portMeta = value
+
+		case "serviceconfigkey":
+			result.serviceConfigKey = strings.TrimPrefix(value, "/")
+
+		case "serviceconfigfromconfigentries":
+			var err error
+
+			result.serviceConfigFromConfigEntries, err = strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("unsupported serviceConfigFromConfigEntries parameter value: '%s'", value)
+			}
+
+		case "subset":
+			result.useSubset = true
+			result.subset = value
+
+		case "regionmeta":
+			result.regionMeta = value
+
+		case "zonemeta":
+			result.zoneMeta = value
+
+		case "transport":
+			switch strings.ToLower(value) {
+			case "http":
+				result.transport = transportHTTP
+			case "dns":
+				result.transport = transportDNS
+			default:
+				return fmt.Errorf("unsupported transport parameter value: '%s'", value)
+			}
+
+		case "onerror":
+			var err error
+
+			result.errorPolicy, err = parseErrorPolicy(value)
+			if err != nil {
+				return err
+			}
+
+		case "errorgraceperiod":
+			var err error
+
+			result.errorGracePeriod, err = time.ParseDuration(value)
+			if err != nil || result.errorGracePeriod <= 0 {
+				return fmt.Errorf("unsupported errorGracePeriod parameter value: '%s'", value)
+			}
+
+		case "maxshrink":
+			var err error
+
+			result.maxShrink, err = parseMaxShrink(value)
+			if err != nil {
+				return err
+			}
+
+		case "maxshrinkwindow":
+			var err error
+
+			result.maxShrinkWindow, err = time.ParseDuration(value)
+			if err != nil || result.maxShrinkWindow <= 0 {
+				return fmt.Errorf("unsupported maxShrinkWindow parameter value: '%s'", value)
+			}
+
+		case "debounce":
+			var err error
+
+			result.debounce, err = time.ParseDuration(value)
+			if err != nil || result.debounce <= 0 {
+				return fmt.Errorf("unsupported debounce parameter value: '%s'", value)
+			}
+
+		case "debouncemaxdelay":
+			var err error
+
+			result.debounceMaxDelay, err = time.ParseDuration(value)
+			if err != nil || result.debounceMaxDelay <= 0 {
+				return fmt.Errorf("unsupported debounceMaxDelay parameter value: '%s'", value)
+			}
+
+		case "initialresolvetimeout":
+			var err error
+
+			result.initialResolveTimeout, err = time.ParseDuration(value)
+			if err != nil || result.initialResolveTimeout <= 0 {
+				return fmt.Errorf("unsupported initialResolveTimeout parameter value: '%s'", value)
+			}
+
+		case "subsetsize":
+			var err error
+
+			result.subsetSize, err = strconv.Atoi(value)
+			if err != nil || result.subsetSize < 1 {
+				return fmt.Errorf("unsupported subsetSize parameter value: '%s'", value)
+			}
 
 		default:
-			return "", nil, healthFilterUndefined, "", fmt.Errorf("unsupported parameter: '%s'", key)
+			return fmt.Errorf("unsupported parameter: '%s'", key)
 		}
 	}
 
-	return scheme, tags, health, token, err
+	return nil
 }
 
-func parseEndpoint(url *url.URL) (serviceName, scheme string, tags []string, health healthFilter, token string, err error) {
-	const defHealthFilter = healthFilterOnlyHealthy
-
+func parseServiceNames(path string) ([]string, error) {
 	// url.Path contains a leading "/", when the URL is in the form
 	// scheme://host/path, remove it
-	serviceName = strings.TrimPrefix(url.Path, "/")
-	if serviceName == "" {
-		return "", "", nil, health, "", errors.New("path is missing in url")
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		return nil, errors.New("path is missing in url")
+	}
+
+	services := strings.Split(path, ",")
+	for i, s := range services {
+		if s == "" {
+			return nil, fmt.Errorf("service name %d in path '%s' is empty", i+1, path)
+		}
 	}
 
-	scheme, tags, health, token, err = extractOpts(url.Query())
+	slices.Sort(services)
+	return slices.Compact(services), nil
+}
+
+func parseEndpoint(url *url.URL) (*resolverOpts, error) {
+	const defHealthFilter = healthFilterOnlyHealthy
+	const defAddressType = addressTypeService
+
+	result := resolverOpts{translateWAN: true}
+	var err error
+
+	result.services, err = parseServiceNames(url.Path)
 	if err != nil {
-		return "", "", nil, health, "", err
+		return nil, err
+	}
+
+	err = extractOpts(url.Query(), &result)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.port != 0 && result.portMeta != "" {
+		return nil, errors.New("port and portMeta parameters are mutually exclusive")
+	}
+
+	if result.serviceConfigFromConfigEntries {
+		if result.serviceConfigKey != "" {
+			return nil, errors.New("serviceConfigKey and serviceConfigFromConfigEntries parameters are mutually exclusive")
+		}
+
+		if len(result.services) > 1 {
+			return nil, errors.New("serviceConfigFromConfigEntries parameter is only supported for a single service")
+		}
+	}
+
+	if result.transport == transportDNS {
+		if err := validateDNSTransportOpts(&result); err != nil {
+			return nil, err
+		}
+
+		// Consul DNS translates addresses itself when
+		// translate_wan_addrs is enabled.
+		result.translateWAN = false
+	}
+
+	if result.health == healthFilterUndefined {
+		result.health = defHealthFilter
+	}
+
+	if result.transport == transportUndefined {
+		result.transport = transportHTTP
+	}
+
+	if result.address == addressTypeUndefined {
+		result.address = defAddressType
+	}
+
+	if result.maxShrink != 0 && result.maxShrinkWindow == 0 {
+		result.maxShrinkWindow = defaultMaxShrinkWindow
 	}
 
-	if health == healthFilterUndefined {
-		health = defHealthFilter
+	if result.debounce != 0 && result.debounceMaxDelay == 0 {
+		result.debounceMaxDelay = defaultDebounceMaxDelayFactor * result.debounce
 	}
 
-	return serviceName, scheme, tags, health, token, nil
+	return &result, nil
 }
 
-func (*resolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
-	serviceName, scheme, tags, health, token, err := parseEndpoint(&target.URL)
+// validateDNSTransportOpts returns an error if opts contains settings that are
+// not supported with the DNS transport.
+func validateDNSTransportOpts(opts *resolverOpts) error {
+	var unsupported []string
+
+	if len(opts.tags) > 1 {
+		unsupported = append(unsupported, "tags with more than one tag")
+	}
+	if len(opts.anyTags) > 0 {
+		unsupported = append(unsupported, "anyTags")
+	}
+	if len(opts.excludeTags) > 0 {
+		unsupported = append(unsupported, "excludeTags")
+	}
+	if opts.health == healthFilterFallbackToUnhealthy {
+		unsupported = append(unsupported, "health=fallbackToUnhealthy")
+	}
+	if opts.address != addressTypeUndefined && opts.address != addressTypeService {
+		unsupported = append(unsupported, "address")
+	}
+	if opts.portMeta != "" {
+		unsupported = append(unsupported, "portMeta")
+	}
+	if opts.serviceConfigKey != "" {
+		unsupported = append(unsupported, "serviceConfigKey")
+	}
+	if opts.serviceConfigFromConfigEntries {
+		unsupported = append(unsupported, "serviceConfigFromConfigEntries")
+	}
+	if opts.useSubset {
+		unsupported = append(unsupported, "subset")
+	}
+	if opts.localityEnabled() {
+		unsupported = append(unsupported, "regionMeta and zoneMeta")
+	}
+
+	if len(unsupported) > 0 {
+		return fmt.Errorf("parameters not supported with transport=dns: %s", strings.Join(unsupported, ", "))
+	}
+
+	return nil
+}
+
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	opts, err := parseEndpoint(&target.URL)
 	if err != nil {
 		return nil, err
 	}
 
-	r, err := newConsulResolver(cc, scheme, target.URL.Host, serviceName, tags, health, token)
+	opts.clientLocality = b.locality
+	opts.clock = b.clock
+	opts.metrics = b.metrics
+	opts.tracerProvider = b.tracerProvider
+	opts.eventHandler = b.eventHandler
+	opts.logger = b.logger
+	opts.target = target.URL.String()
+	opts.cacheDir = b.cacheDir
+	opts.cacheMaxAge = b.cacheMaxAge
+
+	if opts.errorPolicy == 0 {
+		opts.errorPolicy = b.errorPolicy
+	}
+
+	if opts.errorGracePeriod == 0 {
+		opts.errorGracePeriod = b.errorGracePeriod
+	}
+
+	if opts.subsetSize != 0 {
+		opts.clientID = b.clientID
+		if opts.clientID == "" {
+			opts.clientID = defaultClientID()
+		}
+	}
+
+	r, err := newConsulResolver(cc, target.URL.Host, opts)
 	if err != nil {
 		return nil, err
 	}
 
+	b.register(r)
 	r.start()
 
 	return r, nil
 }
 
 // Scheme returns the URI scheme for the resolver
-func (*resolverBuilder) Scheme() string {
+func (*Builder) Scheme() string {
 	return scheme
 }
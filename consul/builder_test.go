@@ -4,6 +4,7 @@ import (
 	"net/url"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func mustParseURL(t *testing.T, strURL string) *url.URL {
@@ -17,131 +18,423 @@ func mustParseURL(t *testing.T, strURL string) *url.URL {
 
 func TestParseEndpoint(t *testing.T) {
 	tests := []struct {
-		endpoint         *url.URL
-		wantServiceName  string
-		wantScheme       string
-		wantTags         []string
-		wantErr          bool
-		wantHealthFilter healthFilter
-		wantToken        string
+		endpoint *url.URL
+		want     *resolverOpts
+		wantErr  bool
 	}{
 		{
-			mustParseURL(t, "consul://127.0.01:8500/user-service-rpc?scheme=https&tags=primary,backup&health=healthy&token=Olj1SIrsGXB_1orYMT71RVCs6FYwGZ_l"),
-			"user-service-rpc",
-			"https",
-			[]string{"primary", "backup"},
-			false,
-			healthFilterOnlyHealthy,
-			"Olj1SIrsGXB_1orYMT71RVCs6FYwGZ_l",
+			endpoint: mustParseURL(t, "consul://127.0.01:8500/user-service-rpc?scheme=https&tags=primary,backup&health=healthy&token=Olj1SIrsGXB_1orYMT71RVCs6FYwGZ_l"),
+			want: &resolverOpts{
+				services:     []string{"user-service-rpc"},
+				scheme:       "https",
+				tags:         []string{"primary", "backup"},
+				health:       healthFilterOnlyHealthy,
+				address:      addressTypeService,
+				translateWAN: true,
+				transport:    transportHTTP,
+				token:        "Olj1SIrsGXB_1orYMT71RVCs6FYwGZ_l",
+			},
 		},
 
 		{
-			mustParseURL(t, "consul://127.0.0.1/user-service-rpc?tags=pri-mary,backup&scheme=http&health=fallbackToUnhealthy"),
-			"user-service-rpc",
-			"http",
-			[]string{"pri-mary", "backup"},
-			false,
-			healthFilterFallbackToUnhealthy,
-			"",
+			endpoint: mustParseURL(t, "consul://127.0.0.1/user-service-rpc?tags=pri-mary,backup&scheme=http&health=fallbackToUnhealthy"),
+			want: &resolverOpts{
+				services:     []string{"user-service-rpc"},
+				scheme:       "http",
+				tags:         []string{"pri-mary", "backup"},
+				health:       healthFilterFallbackToUnhealthy,
+				address:      addressTypeService,
+				translateWAN: true,
+				transport:    transportHTTP,
+			},
 		},
 
 		{
-			mustParseURL(t, "consul://localhost/user-service-rpc"),
-			"user-service-rpc",
-			"",
-			nil,
-			false,
-			healthFilterOnlyHealthy,
-			"",
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc"),
+			want: &resolverOpts{
+				services:     []string{"user-service-rpc"},
+				health:       healthFilterOnlyHealthy,
+				address:      addressTypeService,
+				translateWAN: true,
+				transport:    transportHTTP,
+			},
 		},
 
 		{
-			mustParseURL(t, "consul://consul/user-service-rpc?health=blablub"),
-			"",
-			"",
-			nil,
-			true,
-			healthFilterUndefined,
-			"",
+			endpoint: mustParseURL(t, "consul://consul/user-service-rpc?health=blablub"),
+			wantErr:  true,
 		},
 
 		{
-			mustParseURL(t, "consul://consul:8500/user-service-rpc?scheme=ftp"),
-			"",
-			"",
-			nil,
-			true,
-			healthFilterUndefined,
-			"",
+			endpoint: mustParseURL(t, "consul://consul:8500/user-service-rpc?scheme=ftp"),
+			wantErr:  true,
 		},
 
 		{
-			mustParseURL(t, "consul://[::1]/user-service-rpc?scheme=http?tags=primary"),
-			"",
-			"",
-			nil,
-			true,
-			healthFilterUndefined,
-			"",
+			endpoint: mustParseURL(t, "consul://[::1]/user-service-rpc?scheme=http?tags=primary"),
+			wantErr:  true,
 		},
 
 		{
-			mustParseURL(t, "consul://localhost/user-service-rpc?unsupportedparam=yo"),
-			"",
-			"",
-			nil,
-			true,
-			healthFilterUndefined,
-			"",
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?unsupportedparam=yo"),
+			wantErr:  true,
 		},
 
 		{
-			mustParseURL(t, "consul://127.0.01:8500/user-service-rpc?scheme=http&scheme=https&tags=primary,backup&health=healthy&tags=secondary&health=fallbacktounhealthy"),
-			"user-service-rpc",
-			"https",
-			[]string{"secondary"},
-			false,
-			healthFilterFallbackToUnhealthy,
-			"",
+			endpoint: mustParseURL(t, "consul://127.0.01:8500/user-service-rpc?scheme=http&scheme=https&tags=primary,backup&health=healthy&tags=secondary&health=fallbacktounhealthy"),
+			want: &resolverOpts{
+				services:     []string{"user-service-rpc"},
+				scheme:       "https",
+				tags:         []string{"secondary"},
+				health:       healthFilterFallbackToUnhealthy,
+				address:      addressTypeService,
+				translateWAN: true,
+				transport:    transportHTTP,
+			},
 		},
 
 		{
-			mustParseURL(t, ""),
-			"",
-			"",
-			nil,
-			true,
-			healthFilterUndefined,
-			"",
+			endpoint: mustParseURL(t, "consul://localhost/payments-v1,payments-v2?tags=primary"),
+			want: &resolverOpts{
+				services:     []string{"payments-v1", "payments-v2"},
+				tags:         []string{"primary"},
+				health:       healthFilterOnlyHealthy,
+				address:      addressTypeService,
+				translateWAN: true,
+				transport:    transportHTTP,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/payments-v2,payments-v1,payments-v2"),
+			want: &resolverOpts{
+				services:     []string{"payments-v1", "payments-v2"},
+				health:       healthFilterOnlyHealthy,
+				address:      addressTypeService,
+				translateWAN: true,
+				transport:    transportHTTP,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/payments-v1,,payments-v2"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?tags=primary&anyTags=blue,green&excludeTags=canary,draining"),
+			want: &resolverOpts{
+				services:     []string{"user-service-rpc"},
+				tags:         []string{"primary"},
+				anyTags:      []string{"blue", "green"},
+				excludeTags:  []string{"canary", "draining"},
+				health:       healthFilterOnlyHealthy,
+				address:      addressTypeService,
+				translateWAN: true,
+				transport:    transportHTTP,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?anytags=blue&excludetags=canary"),
+			want: &resolverOpts{
+				services:     []string{"user-service-rpc"},
+				anyTags:      []string{"blue"},
+				excludeTags:  []string{"canary"},
+				health:       healthFilterOnlyHealthy,
+				address:      addressTypeService,
+				translateWAN: true,
+				transport:    transportHTTP,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?address=wan_ipv6"),
+			want: &resolverOpts{
+				services:     []string{"user-service-rpc"},
+				health:       healthFilterOnlyHealthy,
+				address:      addressTypeWANIPv6,
+				translateWAN: true,
+				transport:    transportHTTP,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?address=public"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?dc=dc2&translateWAN=false"),
+			want: &resolverOpts{
+				services:   []string{"user-service-rpc"},
+				health:     healthFilterOnlyHealthy,
+				address:    addressTypeService,
+				datacenter: "dc2",
+				transport:  transportHTTP,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?translateWAN=maybe"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?portMeta=grpc_port"),
+			want: &resolverOpts{
+				services:     []string{"user-service-rpc"},
+				health:       healthFilterOnlyHealthy,
+				address:      addressTypeService,
+				translateWAN: true,
+				transport:    transportHTTP,
+				portMeta:     "grpc_port",
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?port=9000"),
+			want: &resolverOpts{
+				services:     []string{"user-service-rpc"},
+				health:       healthFilterOnlyHealthy,
+				address:      addressTypeService,
+				translateWAN: true,
+				transport:    transportHTTP,
+				port:         9000,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?port=0"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?port=9000&portMeta=grpc_port"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?serviceConfigKey=/grpc/service-config/user-service-rpc"),
+			want: &resolverOpts{
+				services:         []string{"user-service-rpc"},
+				health:           healthFilterOnlyHealthy,
+				address:          addressTypeService,
+				translateWAN:     true,
+				transport:        transportHTTP,
+				serviceConfigKey: "grpc/service-config/user-service-rpc",
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?serviceConfigFromConfigEntries=true"),
+			want: &resolverOpts{
+				services:                       []string{"user-service-rpc"},
+				health:                         healthFilterOnlyHealthy,
+				address:                        addressTypeService,
+				translateWAN:                   true,
+				transport:                      transportHTTP,
+				serviceConfigFromConfigEntries: true,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?serviceConfigFromConfigEntries=true&serviceConfigKey=grpc/service-config/user-service-rpc"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/payments-v1,payments-v2?serviceConfigFromConfigEntries=true"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?subset=v2"),
+			want: &resolverOpts{
+				services:     []string{"user-service-rpc"},
+				health:       healthFilterOnlyHealthy,
+				address:      addressTypeService,
+				translateWAN: true,
+				transport:    transportHTTP,
+				useSubset:    true,
+				subset:       "v2",
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?subset="),
+			want: &resolverOpts{
+				services:     []string{"user-service-rpc"},
+				health:       healthFilterOnlyHealthy,
+				address:      addressTypeService,
+				translateWAN: true,
+				transport:    transportHTTP,
+				useSubset:    true,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?zoneMeta=zone&regionMeta=region"),
+			want: &resolverOpts{
+				services:     []string{"user-service-rpc"},
+				health:       healthFilterOnlyHealthy,
+				address:      addressTypeService,
+				translateWAN: true,
+				transport:    transportHTTP,
+				regionMeta:   "region",
+				zoneMeta:     "zone",
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?subsetSize=20"),
+			want: &resolverOpts{
+				services:     []string{"user-service-rpc"},
+				health:       healthFilterOnlyHealthy,
+				address:      addressTypeService,
+				translateWAN: true,
+				transport:    transportHTTP,
+				subsetSize:   20,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?subsetSize=0"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://127.0.0.1:8600/user-service-rpc?transport=dns&tags=primary&dc=dc2"),
+			want: &resolverOpts{
+				services:   []string{"user-service-rpc"},
+				tags:       []string{"primary"},
+				health:     healthFilterOnlyHealthy,
+				address:    addressTypeService,
+				datacenter: "dc2",
+				transport:  transportDNS,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://127.0.0.1:8600/user-service-rpc?transport=dns&tags=primary,eu"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://127.0.0.1:8600/user-service-rpc?transport=dns&health=fallbackToUnhealthy"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?transport=grpc"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?onError=keepLastState&errorGracePeriod=90s"),
+			want: &resolverOpts{
+				services:         []string{"user-service-rpc"},
+				health:           healthFilterOnlyHealthy,
+				address:          addressTypeService,
+				translateWAN:     true,
+				transport:        transportHTTP,
+				errorPolicy:      ErrorPolicyKeepLastState,
+				errorGracePeriod: 90 * time.Second,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?maxShrink=30%25"),
+			want: &resolverOpts{
+				services:        []string{"user-service-rpc"},
+				health:          healthFilterOnlyHealthy,
+				address:         addressTypeService,
+				translateWAN:    true,
+				transport:       transportHTTP,
+				maxShrink:       30,
+				maxShrinkWindow: 2 * time.Minute,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?maxShrink=50&maxShrinkWindow=30s"),
+			want: &resolverOpts{
+				services:        []string{"user-service-rpc"},
+				health:          healthFilterOnlyHealthy,
+				address:         addressTypeService,
+				translateWAN:    true,
+				transport:       transportHTTP,
+				maxShrink:       50,
+				maxShrinkWindow: 30 * time.Second,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?debounce=200ms"),
+			want: &resolverOpts{
+				services:         []string{"user-service-rpc"},
+				health:           healthFilterOnlyHealthy,
+				address:          addressTypeService,
+				translateWAN:     true,
+				transport:        transportHTTP,
+				debounce:         200 * time.Millisecond,
+				debounceMaxDelay: time.Second,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?initialResolveTimeout=15s"),
+			want: &resolverOpts{
+				services:              []string{"user-service-rpc"},
+				health:                healthFilterOnlyHealthy,
+				address:               addressTypeService,
+				translateWAN:          true,
+				transport:             transportHTTP,
+				initialResolveTimeout: 15 * time.Second,
+			},
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?debounce=0s"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?initialResolveTimeout=abc"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?maxShrink=100"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?onError=ignore"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, "consul://localhost/user-service-rpc?onError=keepLastState&errorGracePeriod=-1s"),
+			wantErr:  true,
+		},
+
+		{
+			endpoint: mustParseURL(t, ""),
+			wantErr:  true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.endpoint.String(), func(t *testing.T) {
-			serviceName, scheme, tags, healthFilter, token, err := parseEndpoint(tt.endpoint)
+			opts, err := parseEndpoint(tt.endpoint)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("parseEndpoint() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 
-			if serviceName != tt.wantServiceName {
-				t.Errorf("parseEndpoint() gotServiceName = %v, want %v", serviceName, tt.wantServiceName)
-			}
-
-			if scheme != tt.wantScheme {
-				t.Errorf("parseEndpoint() gotScheme = %v, want %v", scheme, tt.wantScheme)
-			}
-
-			if !reflect.DeepEqual(tt.wantTags, tags) {
-				t.Errorf("parseEndpoint() gotTags = %+v, want %+v", tags, tt.wantTags)
-			}
-
-			if healthFilter != tt.wantHealthFilter {
-				t.Errorf("parseEndpoint() gotHealthFilter = %v, want %v", healthFilter, tt.wantHealthFilter)
-			}
-
-			if token != tt.wantToken {
-				t.Errorf("parseEndpoint() gotToken = %s, want %s", token, tt.wantToken)
+			if !reflect.DeepEqual(tt.want, opts) {
+				t.Errorf("parseEndpoint() got = %+v, want %+v", opts, tt.want)
 			}
 		})
 	}
@@ -0,0 +1,232 @@
+package consul
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/clock"
+)
+
+// cacheRefreshInterval is the interval in that an unchanged cache file is
+// rewritten to update its timestamp.
+const cacheRefreshInterval = time.Minute
+
+// cacheFile is the content of a file of the endpoint cache.
+type cacheFile struct {
+	Target        string     `json:"target"`
+	Timestamp     time.Time  `json:"timestamp"`
+	Endpoints     [][]string `json:"endpoints"`
+	ServiceConfig string     `json:"serviceConfig,omitempty"`
+}
+
+// endpointCache stores the last successfully resolved endpoints of a target
+// in a file.
+type endpointCache struct {
+	// target is the target with a redacted token, it is stored in the
+	// file. The token is only part of the hash in the file name.
+	target string
+	path   string
+	maxAge time.Duration
+	clock  clock.Clock
+	log    *slog.Logger
+
+	lastWritten     cacheFile
+	lastWrittenTime time.Time
+}
+
+func newEndpointCache(dir, target string, maxAge time.Duration, clk clock.Clock, log *slog.Logger) *endpointCache {
+	h := sha256.Sum256([]byte(target))
+
+	return &endpointCache{
+		target: redactToken(target),
+		path:   filepath.Join(dir, hex.EncodeToString(h[:16])+".json"),
+		maxAge: maxAge,
+		clock:  clk,
+		log:    log,
+	}
+}
+
+// load returns the cached endpoints and the service config JSON.
+// If no cache file exists or it is older than the max age, nil is returned.
+func (c *endpointCache) load() ([]resolver.Endpoint, string, error) {
+	buf, err := os.ReadFile(c.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, "", nil
+		}
+
+		return nil, "", err
+	}
+
+	var f cacheFile
+	if err := json.Unmarshal(buf, &f); err != nil {
+		return nil, "", fmt.Errorf("parsing cache file %s failed: %w", c.path, err)
+	}
+
+	if f.Target != c.target {
+		return nil, "", fmt.Errorf("cache file %s belongs to target %s", c.path, f.Target)
+	}
+
+	if age := c.clock.Since(f.Timestamp); age > c.maxAge {
+		c.log.Info("ignoring cache file, it is older than the max age",
+			"path", c.path,
+			"max_age", c.maxAge,
+			"age", age,
+		)
+		return nil, "", nil
+	}
+
+	endpoints := make([]resolver.Endpoint, 0, len(f.Endpoints))
+	for _, addrs := range f.Endpoints {
+		if len(addrs) == 0 {
+			continue
+		}
+
+		e := resolver.Endpoint{Addresses: make([]resolver.Address, 0, len(addrs))}
+		for _, addr := range addrs {
+			e.Addresses = append(e.Addresses, resolver.Address{Addr: addr})
+		}
+
+		endpoints = append(endpoints, e)
+	}
+
+	return endpoints, f.ServiceConfig, nil
+}
+
+// store writes the endpoints and the service config JSON to the cache file.
+// If they did not change since the last call, the file is only rewritten
+// after cacheRefreshInterval, to keep its timestamp recent.
+func (c *endpointCache) store(endpoints []resolver.Endpoint, serviceConfig string) error {
+	f := cacheFile{
+		Target:        c.target,
+		Endpoints:     make([][]string, 0, len(endpoints)),
+		ServiceConfig: serviceConfig,
+	}
+
+	for _, e := range endpoints {
+		addrs := make([]string, 0, len(e.Addresses))
+		for _, a := range e.Addresses {
+			addrs = append(addrs, a.Addr)
+		}
+
+		f.Endpoints = append(f.Endpoints, addrs)
+	}
+
+	if cacheFilesEqual(&f, &c.lastWritten) && c.clock.Since(c.lastWrittenTime) < cacheRefreshInterval {
+		return nil
+	}
+
+	f.Timestamp = c.clock.Now()
+
+	buf, err := json.Marshal(&f)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(c.path, buf); err != nil {
+		return err
+	}
+
+	c.lastWritten = f
+	c.lastWrittenTime = f.Timestamp
+
+	return nil
+}
+
+func cacheFilesEqual(a, b *cacheFile) bool {
+	return a.Target == b.Target &&
+		a.ServiceConfig == b.ServiceConfig &&
+		slices.EqualFunc(a.Endpoints, b.Endpoints, slices.Equal[[]string])
+}
+
+// writeFileAtomic writes buf to a temporary file and renames it to path, to
+// prevent that a partially written file is read.
+func writeFileAtomic(path string, buf []byte) error {
+	dir := filepath.Dir(path)
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".tmp-"+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(buf); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+// loadCache reports the endpoints that are stored in the cache file of the
+// target, if it exists and is not older than the max age.
+func (c *consulResolver) loadCache() {
+	endpoints, serviceConfigJSON, err := c.cache.load()
+	if err != nil {
+		c.log.Warn("loading cached addresses failed", errAttr(err))
+		return
+	}
+
+	if len(endpoints) == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.log.Warn("reporting stale addresses from cache file until consul has been queried successfully",
+		"path", c.cache.path,
+		"addr_count", len(endpoints),
+	)
+
+	if serviceConfigJSON != "" {
+		if cfg := c.cc.ParseServiceConfig(serviceConfigJSON); cfg.Err == nil {
+			c.serviceConfig = cfg
+			c.serviceConfigJSON = serviceConfigJSON
+		}
+	}
+
+	c.cachedEndpoints = endpoints
+	c.updateState()
+}
+
+// storeCache writes the last reported endpoints to the cache file.
+// c.mutex must be held when calling the method.
+func (c *consulResolver) storeCache() {
+	if c.cache == nil ||
+		c.cachedEndpoints != nil ||
+		!c.serviceConfigLoaded ||
+		c.lastReporterState.err != nil ||
+		c.lastReporterState.endpoints == nil {
+		return
+	}
+
+	if err := c.cache.store(c.lastReporterState.endpoints, c.serviceConfigJSON); err != nil {
+		c.log.Warn("writing addresses to cache file failed", "path", c.cache.path, errAttr(err))
+	}
+}
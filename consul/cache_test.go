@@ -0,0 +1,141 @@
+package consul
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/clock"
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+func TestCachedAddressesAreReportedWhenConsulIsUnreachable(t *testing.T) {
+	cacheDir := t.TempDir()
+	target := resolver.Target{URL: url.URL{Scheme: "consul", Path: "user-service"}}
+
+	health := mocks.NewConsulHealthClient()
+	health.SetRespServiceEntries([]*consul.AgentService{
+		{Address: "10.0.0.1", Port: 1},
+		{Address: "10.0.0.2", Port: 1},
+	})
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	builder := NewBuilder(WithCacheDir(cacheDir))
+	want := []resolver.Address{{Addr: "10.0.0.1:1"}, {Addr: "10.0.0.2:1"}}
+
+	cc := mocks.NewClientConn()
+	r, err := builder.Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+
+	waitForAddrs(t, cc, want)
+	r.Close()
+
+	health.SetRespError(errors.New("connection refused"))
+
+	cc = mocks.NewClientConn()
+	r, err = builder.Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	waitForAddrs(t, cc, want)
+
+	for health.ResolveCount() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if cnt := cc.ReportErrorCallCnt(); cnt != 0 {
+		t.Errorf("ReportError was called %d times while cached addresses are used, expected 0", cnt)
+	}
+
+	health.SetRespServiceEntries([]*consul.AgentService{
+		{Address: "10.0.0.3", Port: 1},
+	})
+	health.SetRespError(nil)
+	r.ResolveNow(resolver.ResolveNowOptions{})
+
+	waitForAddrs(t, cc, []resolver.Address{{Addr: "10.0.0.3:1"}})
+
+	t.Run("errorsAreReportedAfterCacheWasReplaced", func(t *testing.T) {
+		health.SetRespError(errors.New("connection refused"))
+		r.ResolveNow(resolver.ResolveNowOptions{})
+
+		waitFor(t, func() bool { return cc.ReportErrorCallCnt() > 0 }, "ReportError was not called")
+	})
+}
+
+func TestCacheIgnoresExpiredFiles(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	clk := mocks.NewClock()
+	cache := newEndpointCache(cacheDir, "consul:///user-service", time.Hour, clk, testLogger)
+	err := cache.store([]resolver.Endpoint{{Addresses: []resolver.Address{{Addr: "10.0.0.1:1"}}}}, "")
+	if err != nil {
+		t.Fatal("store() failed:", err)
+	}
+
+	endpoints, _, err := cache.load()
+	if err != nil {
+		t.Fatal("load() failed:", err)
+	}
+
+	if len(endpoints) != 1 {
+		t.Fatalf("loaded %d endpoints, expected 1", len(endpoints))
+	}
+
+	clk.Advance(time.Hour + time.Second)
+	endpoints, _, err = cache.load()
+	if err != nil {
+		t.Fatal("load() failed:", err)
+	}
+
+	if len(endpoints) != 0 {
+		t.Errorf("loaded %d endpoints from an expired cache file, expected 0", len(endpoints))
+	}
+
+	if _, _, err := newEndpointCache(cacheDir, "consul:///other-service", time.Hour, clock.Real{}, testLogger).load(); err != nil {
+		t.Errorf("load() for a target without cache file failed: %s", err)
+	}
+}
+
+func TestCacheFileDoesNotContainToken(t *testing.T) {
+	cacheDir := t.TempDir()
+	cache := newEndpointCache(cacheDir, "consul://localhost/user-service?token=secret", time.Hour, clock.Real{}, testLogger)
+
+	endpoints := []resolver.Endpoint{{Addresses: []resolver.Address{{Addr: "10.0.0.1:1"}}}}
+	if err := cache.store(endpoints, ""); err != nil {
+		t.Fatal("storing endpoints failed:", err)
+	}
+
+	buf, err := os.ReadFile(cache.path)
+	if err != nil {
+		t.Fatal("reading cache file failed:", err)
+	}
+
+	if strings.Contains(string(buf), "secret") {
+		t.Errorf("cache file contains the token: %s", buf)
+	}
+
+	got, _, err := newEndpointCache(cacheDir, "consul://localhost/user-service?token=secret", time.Hour, clock.Real{}, testLogger).load()
+	if err != nil {
+		t.Fatal("loading endpoints failed:", err)
+	}
+
+	if !reflect.DeepEqual(got, endpoints) {
+		t.Errorf("loaded endpoints are %+v, expected %+v", got, endpoints)
+	}
+}
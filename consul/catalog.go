@@ -0,0 +1,140 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+type consulCatalogEndpoint interface {
+	Service(service, tag string, q *consul.QueryOptions) ([]*consul.CatalogService, *consul.QueryMeta, error)
+}
+
+// consulCreateCatalogClientFn can be overwritten in tests to make
+// newConsulResolver() return a different consulCatalogEndpoint
+// implementation
+var consulCreateCatalogClientFn = func(cfg *consul.Config) (consulCatalogEndpoint, error) {
+	clt, err := consul.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return clt.Catalog(), nil
+}
+
+// registrationCheck is the result of checking why a query for a service
+// returned no instances.
+type registrationCheck struct {
+	// index is the index of the health query that returned no
+	// instances, the check is repeated when it changes.
+	index uint64
+	// reason describes why no instances were returned, it is nil if the
+	// reason is unknown.
+	reason error
+}
+
+// checkRegistration queries the catalog to find out why the query of svc
+// with the index returned no instances. The result is cached until the
+// index changes.
+// passingOnly must be the value that was passed to the health query.
+func (c *consulResolver) checkRegistration(svc *serviceWatcher, passingOnly bool, index uint64) {
+	if c.consulCatalog == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	cached := svc.registration != nil && svc.registration.index == index
+	c.mutex.Unlock()
+	if cached {
+		return
+	}
+
+	opts := (&consul.QueryOptions{Datacenter: c.opts.datacenter}).WithContext(c.ctx)
+
+	instances, _, err := c.consulCatalog.Service(svc.name, "", opts)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			svc.log.Warn("querying the consul catalog for registered instances of service failed", errAttr(err))
+		}
+
+		svc.registration = nil
+		return
+	}
+
+	svc.registration = &registrationCheck{
+		index:  index,
+		reason: c.noInstancesReason(svc.name, passingOnly, instances),
+	}
+}
+
+// noInstancesReason returns an error that describes why a health query for
+// service returned no instances, when instances are the registered instances
+// of the service in the catalog. The tag filters of the resolver are applied
+// to instances. It returns nil if the reason is unknown, e.g. when the
+// instances could have been filtered by the portMeta or subset OPTs.
+func (c *consulResolver) noInstancesReason(service string, passingOnly bool, instances []*consul.CatalogService) error {
+	if len(instances) == 0 {
+		if c.opts.datacenter != "" {
+			return fmt.Errorf("service %q is not registered in datacenter %s", service, c.opts.datacenter)
+		}
+
+		return fmt.Errorf("service %q is not registered", service)
+	}
+
+	tagged := slices.DeleteFunc(slices.Clone(instances), func(s *consul.CatalogService) bool {
+		for _, tag := range c.opts.tags {
+			if !slices.Contains(s.ServiceTags, tag) {
+				return true
+			}
+		}
+
+		return !matchesTagFilters(s.ServiceTags, c.opts.anyTags, c.opts.excludeTags)
+	})
+	if len(tagged) == 0 {
+		if len(c.opts.anyTags) > 0 || len(c.opts.excludeTags) > 0 {
+			return fmt.Errorf("none of the %d instances of %q match the tag filters", len(instances), service)
+		}
+
+		return fmt.Errorf("none of the %d instances of %q have the tags %s",
+			len(instances), service, strings.Join(c.opts.tags, ", "))
+	}
+
+	if passingOnly && c.opts.portMeta == "" && !c.opts.useSubset {
+		return fmt.Errorf("0 of %d instances of %q are passing", len(tagged), service)
+	}
+
+	return nil
+}
+
+// noInstancesError returns an error that describes why none of the
+// resolved services has instances, it is nil if the reasons are unknown.
+// The errors of services whose queries failed are included, to not hide
+// them behind the reasons.
+// c.mutex must be held when calling the method.
+func (c *consulResolver) noInstancesError() error {
+	var reasons, errs []error
+	for _, svc := range c.services {
+		switch {
+		case svc.resolved && len(svc.endpoints) == 0 &&
+			svc.registration != nil && svc.registration.reason != nil:
+			reasons = append(reasons, svc.registration.reason)
+
+		case !svc.resolved && svc.err != nil:
+			errs = append(errs, fmt.Errorf("resolving service '%s' failed: %w", svc.name, svc.err))
+		}
+	}
+
+	if len(reasons) == 0 {
+		return nil
+	}
+
+	return errors.Join(append(reasons, errs...)...)
+}
@@ -0,0 +1,240 @@
+package consul
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+func TestNoInstancesErrorDescribesReason(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    url.URL
+		entries   []*consul.AgentService
+		instances []*consul.CatalogService
+		// wantErr is the expected reported error, if it is empty an
+		// empty state is expected
+		wantErr string
+	}{
+		{
+			name:    "notRegistered",
+			target:  url.URL{Path: "paymnts", RawQuery: "dc=dc1"},
+			wantErr: `service "paymnts" is not registered in datacenter dc1`,
+		},
+		{
+			name:   "noPassingInstances",
+			target: url.URL{Path: "payments"},
+			instances: []*consul.CatalogService{
+				{ServiceID: "1"}, {ServiceID: "2"}, {ServiceID: "3"}, {ServiceID: "4"}, {ServiceID: "5"},
+			},
+			wantErr: `0 of 5 instances of "payments" are passing`,
+		},
+		{
+			name:   "noInstancesWithTags",
+			target: url.URL{Path: "payments", RawQuery: "tags=primary"},
+			instances: []*consul.CatalogService{
+				{ServiceID: "1", ServiceTags: []string{"secondary"}},
+				{ServiceID: "2"},
+			},
+			wantErr: `none of the 2 instances of "payments" have the tags primary`,
+		},
+		{
+			name:    "noInstancesWithoutExcludedTags",
+			target:  url.URL{Path: "payments", RawQuery: "excludeTags=canary"},
+			entries: []*consul.AgentService{{Address: "10.0.0.1", Port: 1, Tags: []string{"canary"}}},
+			instances: []*consul.CatalogService{
+				{ServiceID: "1", ServiceTags: []string{"canary"}},
+				{ServiceID: "2", ServiceTags: []string{"canary"}},
+			},
+			wantErr: `none of the 2 instances of "payments" match the tag filters`,
+		},
+		{
+			name:    "noPassingInstancesWithoutExcludedTags",
+			target:  url.URL{Path: "payments", RawQuery: "excludeTags=canary"},
+			entries: []*consul.AgentService{{Address: "10.0.0.1", Port: 1, Tags: []string{"canary"}}},
+			instances: []*consul.CatalogService{
+				{ServiceID: "1", ServiceTags: []string{"canary"}},
+				{ServiceID: "2"},
+			},
+			wantErr: `0 of 1 instances of "payments" are passing`,
+		},
+		{
+			name:      "instancesWithoutPortMeta",
+			target:    url.URL{Path: "payments", RawQuery: "portMeta=grpc_port"},
+			entries:   []*consul.AgentService{{Address: "10.0.0.1", Port: 1}},
+			instances: []*consul.CatalogService{{ServiceID: "1"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			health := mocks.NewConsulHealthClient()
+			health.SetRespServiceEntries(tt.entries)
+			t.Cleanup(replaceCreateHealthClientFn(
+				func(*consul.Config) (consulHealthEndpoint, error) {
+					return health, nil
+				},
+			))
+
+			catalog := mocks.NewConsulCatalogClient()
+			catalog.SetServiceInstances("payments", tt.instances)
+			t.Cleanup(replaceCreateCatalogClientFn(
+				func(*consul.Config) (consulCatalogEndpoint, error) {
+					return catalog, nil
+				},
+			))
+
+			cc := mocks.NewClientConn()
+			r, err := NewBuilder().Build(resolver.Target{URL: tt.target}, cc, resolver.BuildOptions{})
+			if err != nil {
+				t.Fatal("Build() failed:", err.Error())
+			}
+			t.Cleanup(r.Close)
+
+			if tt.wantErr == "" {
+				waitFor(t, func() bool { return cc.UpdateStateCallCnt() > 0 }, "UpdateState was not called")
+
+				if len(cc.Addrs()) != 0 || cc.ReportErrorCallCnt() != 0 {
+					t.Errorf("resolver reported addresses %+v and error %v, expected an empty state",
+						cc.Addrs(), cc.LastReportedError())
+				}
+
+				return
+			}
+
+			waitFor(t, func() bool { return cc.ReportErrorCallCnt() > 0 }, "ReportError was not called")
+
+			if err := cc.LastReportedError(); err == nil || err.Error() != tt.wantErr {
+				t.Errorf("reported error is %q, expected %q", err, tt.wantErr)
+			}
+
+			if cnt := cc.UpdateStateCallCnt(); cnt != 0 {
+				t.Errorf("UpdateState was called %d times, expected no calls", cnt)
+			}
+		})
+	}
+}
+
+func TestNoInstancesErrorIncludesFailedServices(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	health.ServiceMultipleTagsFn = func(c *mocks.ConsulHealthClient, service string, _ []string, _ bool, _ *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+		c.Mutex.Lock()
+		c.ResolveCnt++
+		c.Mutex.Unlock()
+
+		if service == "billing" {
+			return nil, nil, errors.New("ACL not found")
+		}
+
+		return nil, &consul.QueryMeta{LastIndex: 1}, nil
+	}
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	t.Cleanup(replaceCreateCatalogClientFn(
+		func(*consul.Config) (consulCatalogEndpoint, error) {
+			return mocks.NewConsulCatalogClient(), nil
+		},
+	))
+
+	cc := mocks.NewClientConn()
+	r, err := NewBuilder().Build(resolver.Target{URL: url.URL{Path: "payments,billing"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	const (
+		wantReason = `service "payments" is not registered`
+		wantErr    = "resolving service 'billing' failed: ACL not found"
+	)
+
+	waitFor(t, func() bool {
+		err := cc.LastReportedError()
+		return err != nil && strings.Contains(err.Error(), wantReason) && strings.Contains(err.Error(), wantErr)
+	}, "reported error does not contain %q and %q", wantReason, wantErr)
+}
+
+func TestEmptyStateIsReportedWhenCatalogQueryFails(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	health.SetRespServiceEntries(nil)
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	catalog := mocks.NewConsulCatalogClient()
+	catalog.SetRespError(errors.New("connection refused"))
+	t.Cleanup(replaceCreateCatalogClientFn(
+		func(*consul.Config) (consulCatalogEndpoint, error) {
+			return catalog, nil
+		},
+	))
+
+	cc := mocks.NewClientConn()
+	r, err := NewBuilder().Build(resolver.Target{URL: url.URL{Path: "payments"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	waitFor(t, func() bool { return cc.UpdateStateCallCnt() > 0 }, "UpdateState was not called")
+
+	if len(cc.Addrs()) != 0 || cc.ReportErrorCallCnt() != 0 {
+		t.Errorf("resolver reported addresses %+v and error %v, expected an empty state", cc.Addrs(), cc.LastReportedError())
+	}
+}
+
+func TestRegistrationCheckIsCachedByIndex(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	health.SetRespServiceEntries(nil)
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	catalog := mocks.NewConsulCatalogClient()
+	t.Cleanup(replaceCreateCatalogClientFn(
+		func(*consul.Config) (consulCatalogEndpoint, error) {
+			return catalog, nil
+		},
+	))
+
+	cc := mocks.NewClientConn()
+	clk := mocks.NewClock()
+	r, err := NewBuilder(withClock(clk)).Build(resolver.Target{URL: url.URL{Path: "payments"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	waitFor(t, func() bool { return cc.ReportErrorCallCnt() > 0 }, "ReportError was not called")
+
+	// the mock responds with the same index, the watcher delays the
+	// queries because they return too fast
+	waitFor(t, func() bool {
+		if health.ResolveCount() >= 4 {
+			return true
+		}
+
+		clk.Advance(time.Second)
+
+		return false
+	}, "service was not queried again")
+
+	if cnt := catalog.ServiceCallCnt(); cnt != 1 {
+		t.Errorf("catalog was queried %d times, expected 1", cnt)
+	}
+}
@@ -0,0 +1,425 @@
+package consul
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+type consulConfigEntriesEndpoint interface {
+	List(kind string, q *consul.QueryOptions) ([]consul.ConfigEntry, *consul.QueryMeta, error)
+}
+
+// consulCreateConfigEntriesClientFn can be overwritten in tests to make
+// newConsulResolver() return a different consulConfigEntriesEndpoint
+// implementation
+var consulCreateConfigEntriesClientFn = func(cfg *consul.Config) (consulConfigEntriesEndpoint, error) {
+	clt, err := consul.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return clt.ConfigEntries(), nil
+}
+
+// configEntryWatcher monitors the config entry of kind with the given name with
+// blocking queries.
+// onChange is called with the entry when the result of the first query is
+// available and afterwards when the entry changed. If the entry does not
+// exist, onChange is called with nil.
+// queryFailed is called when a query failed.
+func (c *consulResolver) configEntryWatcher(kind, name string, onChange func(consul.ConfigEntry), queryFailed func(error)) {
+	var lastModifyIndex uint64
+	var loaded bool
+
+	descr := fmt.Sprintf("consul %s config entry '%s'", kind, name)
+
+	// Config entries are listed instead of retrieved via Get because
+	// Get fails when the entry does not exist and then does not support
+	// blocking queries.
+	c.blockingQueryLoop(descr, func(opts *consul.QueryOptions) (uint64, bool, error) {
+		entries, meta, err := c.consulConfigEntries.List(kind, opts)
+		if err != nil {
+			return 0, false, err
+		}
+
+		var entry consul.ConfigEntry
+		var modifyIndex uint64
+
+		for _, e := range entries {
+			if e.GetName() == name {
+				entry = e
+				modifyIndex = e.GetModifyIndex()
+				break
+			}
+		}
+
+		if loaded && modifyIndex == lastModifyIndex {
+			return meta.LastIndex, false, nil
+		}
+
+		loaded = true
+		lastModifyIndex = modifyIndex
+
+		onChange(entry)
+
+		return meta.LastIndex, true, nil
+	}, queryFailed)
+}
+
+// configEntriesServiceConfig holds the config entries from which the gRPC
+// service config is generated.
+type configEntriesServiceConfig struct {
+	// mutex serializes updates of the fields and the calls of
+	// setServiceConfig.
+	mutex         sync.Mutex
+	resolverEntry *consul.ServiceResolverConfigEntry
+	routerEntry   *consul.ServiceRouterConfigEntry
+	// pending contains the kinds of config entries for which no query
+	// finished yet.
+	pending map[string]struct{}
+	// loaded is true when a query for one of the entries succeeded.
+	loaded bool
+}
+
+// serviceConfigConfigEntriesWatcher monitors the service-resolver and
+// service-router config entry of the service and reports the service config
+// generated from them via c.setServiceConfig().
+func (c *consulResolver) serviceConfigConfigEntriesWatcher() {
+	service := c.opts.services[0]
+	source := "consul config entries of service '" + service + "'"
+
+	cfg := configEntriesServiceConfig{
+		pending: map[string]struct{}{
+			consul.ServiceResolver: {},
+			consul.ServiceRouter:   {},
+		},
+	}
+
+	update := func(kind string, entry consul.ConfigEntry, queryErr error) {
+		cfg.mutex.Lock()
+		defer cfg.mutex.Unlock()
+
+		delete(cfg.pending, kind)
+
+		if queryErr == nil {
+			cfg.loaded = true
+
+			switch e := entry.(type) {
+			case *consul.ServiceResolverConfigEntry:
+				cfg.resolverEntry = e
+			case *consul.ServiceRouterConfigEntry:
+				cfg.routerEntry = e
+			case nil:
+				if kind == consul.ServiceResolver {
+					cfg.resolverEntry = nil
+				} else {
+					cfg.routerEntry = nil
+				}
+			}
+		}
+
+		if len(cfg.pending) != 0 || !cfg.loaded {
+			return
+		}
+
+		js, err := serviceConfigFromConfigEntries(c.log, service, cfg.resolverEntry, cfg.routerEntry)
+		if err != nil {
+			c.log.Warn("generating service config failed", "source", source, errAttr(err))
+			return
+		}
+
+		c.setServiceConfig(source, js)
+	}
+
+	for _, kind := range []string{consul.ServiceResolver, consul.ServiceRouter} {
+		c.wgStop.Add(1)
+		go func() {
+			defer c.wgStop.Done()
+
+			c.configEntryWatcher(kind, service, func(entry consul.ConfigEntry) {
+				update(kind, entry, nil)
+			}, func(err error) {
+				c.serviceConfigQueryFailed()
+				update(kind, nil, err)
+			})
+		}()
+	}
+}
+
+type grpcServiceConfig struct {
+	LoadBalancingConfig []map[string]any   `json:"loadBalancingConfig,omitempty"`
+	MethodConfig        []grpcMethodConfig `json:"methodConfig,omitempty"`
+}
+
+type grpcMethodConfig struct {
+	Name        []grpcMethodName `json:"name"`
+	Timeout     string           `json:"timeout,omitempty"`
+	RetryPolicy *grpcRetryPolicy `json:"retryPolicy,omitempty"`
+}
+
+type grpcMethodName struct {
+	Service string `json:"service,omitempty"`
+	Method  string `json:"method,omitempty"`
+}
+
+type grpcRetryPolicy struct {
+	MaxAttempts          int      `json:"maxAttempts"`
+	InitialBackoff       string   `json:"initialBackoff"`
+	MaxBackoff           string   `json:"maxBackoff"`
+	BackoffMultiplier    float64  `json:"backoffMultiplier"`
+	RetryableStatusCodes []string `json:"retryableStatusCodes"`
+}
+
+// retryOnStatusCodes maps the Envoy retry conditions that can be set in
+// [consul.ServiceRouteDestination.RetryOn] to gRPC status codes.
+var retryOnStatusCodes = map[string]string{
+	"5xx":                "UNAVAILABLE",
+	"gateway-error":      "UNAVAILABLE",
+	"reset":              "UNAVAILABLE",
+	"connect-failure":    "UNAVAILABLE",
+	"refused-stream":     "UNAVAILABLE",
+	"cancelled":          "CANCELLED",
+	"deadline-exceeded":  "DEADLINE_EXCEEDED",
+	"internal":           "INTERNAL",
+	"resource-exhausted": "RESOURCE_EXHAUSTED",
+	"unavailable":        "UNAVAILABLE",
+}
+
+// serviceConfigFromConfigEntries generates a JSON gRPC service config for
+// service from its service-resolver and service-router config entry.
+// Both entries can be nil. If the entries contain no settings that can be
+// expressed in a gRPC service config, an empty string is returned.
+//
+// The following settings are translated:
+//   - service-resolver LoadBalancer policies round_robin and least_request
+//     to the loadBalancingConfig,
+//   - service-resolver RequestTimeout to the timeout of all methods,
+//   - service-router routes that match a gRPC service or method via
+//     PathExact or PathPrefix and have the service itself as destination:
+//     RequestTimeout to the timeout, NumRetries, RetryOn,
+//     RetryOnConnectFailure and RetryOnStatusCodes to the retryPolicy of
+//     the matched methods.
+//
+// Routes that can not be translated are ignored. service-defaults config
+// entries are not used, their settings, e.g. the protocol, upstream limits
+// and mesh gateway mode, have no equivalent in a gRPC service config.
+func serviceConfigFromConfigEntries(
+	log *slog.Logger,
+	service string,
+	resolverEntry *consul.ServiceResolverConfigEntry,
+	routerEntry *consul.ServiceRouterConfigEntry,
+) (string, error) {
+	var result grpcServiceConfig
+	var defaultTimeout time.Duration
+
+	if resolverEntry != nil {
+		defaultTimeout = resolverEntry.RequestTimeout
+		result.LoadBalancingConfig = loadBalancingConfig(log, resolverEntry.LoadBalancer)
+	}
+
+	hasDefaultRoute := false
+
+	if routerEntry != nil {
+		seen := map[grpcMethodName]struct{}{}
+
+		for i, route := range routerEntry.Routes {
+			name, err := routeMethodName(route.Match)
+			if err != nil {
+				log.Warn("ignoring route of service-router config entry",
+					"route", i,
+					"config_entry", routerEntry.Name,
+					errAttr(err),
+				)
+				continue
+			}
+
+			if route.Destination != nil &&
+				((route.Destination.Service != "" && route.Destination.Service != service) ||
+					route.Destination.ServiceSubset != "") {
+				log.Warn("ignoring route of service-router config entry, routing to other services or subsets is not supported",
+					"route", i,
+					"config_entry", routerEntry.Name,
+				)
+				continue
+			}
+
+			// Routes are evaluated in order, the first match wins.
+			if _, exists := seen[name]; exists {
+				continue
+			}
+			seen[name] = struct{}{}
+
+			if name == (grpcMethodName{}) {
+				hasDefaultRoute = true
+			}
+
+			mc := grpcMethodConfig{
+				Name:    []grpcMethodName{name},
+				Timeout: formatDuration(defaultTimeout),
+			}
+
+			if route.Destination != nil {
+				if route.Destination.RequestTimeout != 0 {
+					mc.Timeout = formatDuration(route.Destination.RequestTimeout)
+				}
+
+				mc.RetryPolicy = retryPolicy(route.Destination)
+			}
+
+			if mc.Timeout == "" && mc.RetryPolicy == nil {
+				continue
+			}
+
+			result.MethodConfig = append(result.MethodConfig, mc)
+		}
+	}
+
+	if !hasDefaultRoute && defaultTimeout != 0 {
+		result.MethodConfig = append(result.MethodConfig, grpcMethodConfig{
+			Name:    []grpcMethodName{{}},
+			Timeout: formatDuration(defaultTimeout),
+		})
+	}
+
+	if result.LoadBalancingConfig == nil && result.MethodConfig == nil {
+		return "", nil
+	}
+
+	js, err := json.Marshal(&result)
+	if err != nil {
+		return "", err
+	}
+
+	return string(js), nil
+}
+
+func loadBalancingConfig(log *slog.Logger, lb *consul.LoadBalancer) []map[string]any {
+	if lb == nil {
+		return nil
+	}
+
+	switch lb.Policy {
+	case "round_robin":
+		return []map[string]any{{"round_robin": struct{}{}}}
+
+	case "least_request":
+		cfg := map[string]any{}
+		if lb.LeastRequestConfig != nil && lb.LeastRequestConfig.ChoiceCount >= 2 {
+			cfg["choiceCount"] = lb.LeastRequestConfig.ChoiceCount
+		}
+
+		// least_request_experimental is not supported by all gRPC
+		// versions, the first supported policy is used.
+		return []map[string]any{
+			{"least_request_experimental": cfg},
+			{"round_robin": struct{}{}},
+		}
+
+	default:
+		log.Debug("load balancer policy can not be translated to a gRPC load balancing config, ignoring it",
+			"policy", lb.Policy,
+		)
+
+		return nil
+	}
+}
+
+// routeMethodName returns the gRPC method name that corresponds to the
+// route match.
+// A nil match or a match of all paths results in an empty method name that
+// matches all methods.
+func routeMethodName(match *consul.ServiceRouteMatch) (grpcMethodName, error) {
+	if match == nil || match.HTTP == nil {
+		return grpcMethodName{}, nil
+	}
+
+	m := match.HTTP
+	if m.PathRegex != "" || len(m.Header) != 0 || len(m.QueryParam) != 0 || len(m.Methods) != 0 {
+		return grpcMethodName{}, errors.New("only PathExact and PathPrefix matches are supported")
+	}
+
+	if m.PathExact != "" {
+		svc, method, found := strings.Cut(strings.TrimPrefix(m.PathExact, "/"), "/")
+		if !found || svc == "" || method == "" || strings.Contains(method, "/") {
+			return grpcMethodName{}, fmt.Errorf("PathExact '%s' is not a gRPC method path", m.PathExact)
+		}
+
+		return grpcMethodName{Service: svc, Method: method}, nil
+	}
+
+	svc := strings.TrimSuffix(strings.TrimPrefix(m.PathPrefix, "/"), "/")
+	if strings.Contains(svc, "/") {
+		return grpcMethodName{}, fmt.Errorf("PathPrefix '%s' is not a gRPC service path", m.PathPrefix)
+	}
+
+	return grpcMethodName{Service: svc}, nil
+}
+
+// retryPolicy returns the gRPC retry policy for the retry settings of dest.
+// If dest has no retry settings, nil is returned.
+func retryPolicy(dest *consul.ServiceRouteDestination) *grpcRetryPolicy {
+	var codes []string
+
+	for _, cond := range dest.RetryOn {
+		if code, exists := retryOnStatusCodes[cond]; exists {
+			codes = append(codes, code)
+		}
+	}
+
+	if dest.RetryOnConnectFailure {
+		codes = append(codes, "UNAVAILABLE")
+	}
+
+	for _, httpCode := range dest.RetryOnStatusCodes {
+		// HTTP status codes that gRPC maps to UNAVAILABLE
+		switch httpCode {
+		case 429, 502, 503, 504:
+			codes = append(codes, "UNAVAILABLE")
+		}
+	}
+
+	if dest.NumRetries == 0 && len(codes) == 0 {
+		return nil
+	}
+
+	if len(codes) == 0 {
+		codes = []string{"UNAVAILABLE"}
+	}
+
+	slices.Sort(codes)
+
+	// Envoy retries once if retry conditions are defined without
+	// NumRetries.
+	maxAttempts := 2
+	if dest.NumRetries > 0 {
+		maxAttempts = int(dest.NumRetries) + 1
+	}
+
+	// The backoff values are the defaults of Envoy.
+	return &grpcRetryPolicy{
+		MaxAttempts:          maxAttempts,
+		InitialBackoff:       "0.025s",
+		MaxBackoff:           "0.25s",
+		BackoffMultiplier:    2,
+		RetryableStatusCodes: slices.Compact(codes),
+	}
+}
+
+// formatDuration formats d in the JSON representation of a protobuf
+// Duration. If d is 0, an empty string is returned.
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
@@ -0,0 +1,210 @@
+package consul
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+func replaceCreateConfigEntriesClientFn(fn func(cfg *consul.Config) (consulConfigEntriesEndpoint, error)) func() {
+	old := consulCreateConfigEntriesClientFn
+
+	consulCreateConfigEntriesClientFn = fn
+
+	return func() {
+		consulCreateConfigEntriesClientFn = old
+	}
+}
+
+func TestServiceConfigFromConfigEntries(t *testing.T) {
+	tests := []struct {
+		name          string
+		resolverEntry *consul.ServiceResolverConfigEntry
+		routerEntry   *consul.ServiceRouterConfigEntry
+		want          string
+	}{
+		{
+			name: "noEntries",
+			want: "",
+		},
+
+		{
+			name: "resolverWithoutSupportedSettings",
+			resolverEntry: &consul.ServiceResolverConfigEntry{
+				ConnectTimeout: time.Second,
+				LoadBalancer:   &consul.LoadBalancer{Policy: "maglev"},
+			},
+			want: "",
+		},
+
+		{
+			name: "resolverRoundRobinAndTimeout",
+			resolverEntry: &consul.ServiceResolverConfigEntry{
+				RequestTimeout: 1500 * time.Millisecond,
+				LoadBalancer:   &consul.LoadBalancer{Policy: "round_robin"},
+			},
+			want: `{"loadBalancingConfig":[{"round_robin":{}}],"methodConfig":[{"name":[{}],"timeout":"1.5s"}]}`,
+		},
+
+		{
+			name: "resolverLeastRequest",
+			resolverEntry: &consul.ServiceResolverConfigEntry{
+				LoadBalancer: &consul.LoadBalancer{
+					Policy:             "least_request",
+					LeastRequestConfig: &consul.LeastRequestConfig{ChoiceCount: 3},
+				},
+			},
+			want: `{"loadBalancingConfig":[{"least_request_experimental":{"choiceCount":3}},{"round_robin":{}}]}`,
+		},
+
+		{
+			name: "routes",
+			resolverEntry: &consul.ServiceResolverConfigEntry{
+				RequestTimeout: 10 * time.Second,
+			},
+			routerEntry: &consul.ServiceRouterConfigEntry{
+				Name: "user-service",
+				Routes: []consul.ServiceRoute{
+					{
+						Match: &consul.ServiceRouteMatch{HTTP: &consul.ServiceRouteHTTPMatch{PathExact: "/user.v1.UserService/GetUser"}},
+						Destination: &consul.ServiceRouteDestination{
+							RequestTimeout:        time.Second,
+							NumRetries:            3,
+							RetryOnConnectFailure: true,
+							RetryOn:               []string{"deadline-exceeded", "unknown-condition"},
+							RetryOnStatusCodes:    []uint32{503, 500},
+						},
+					},
+					{
+						Match:       &consul.ServiceRouteMatch{HTTP: &consul.ServiceRouteHTTPMatch{PathPrefix: "/user.v1.UserService/"}},
+						Destination: &consul.ServiceRouteDestination{RetryOn: []string{"unavailable"}},
+					},
+					{
+						// duplicate match, ignored because
+						// the previous route matches first
+						Match:       &consul.ServiceRouteMatch{HTTP: &consul.ServiceRouteHTTPMatch{PathPrefix: "/user.v1.UserService"}},
+						Destination: &consul.ServiceRouteDestination{RequestTimeout: time.Minute},
+					},
+					{
+						// unsupported match, ignored
+						Match:       &consul.ServiceRouteMatch{HTTP: &consul.ServiceRouteHTTPMatch{PathRegex: "/admin.*"}},
+						Destination: &consul.ServiceRouteDestination{RequestTimeout: time.Minute},
+					},
+					{
+						// routes to another service, ignored
+						Match:       &consul.ServiceRouteMatch{HTTP: &consul.ServiceRouteHTTPMatch{PathPrefix: "/admin.v1.Admin/"}},
+						Destination: &consul.ServiceRouteDestination{Service: "admin-service"},
+					},
+				},
+			},
+			want: `{"methodConfig":[` +
+				`{"name":[{"service":"user.v1.UserService","method":"GetUser"}],"timeout":"1s","retryPolicy":{"maxAttempts":4,"initialBackoff":"0.025s","maxBackoff":"0.25s","backoffMultiplier":2,"retryableStatusCodes":["DEADLINE_EXCEEDED","UNAVAILABLE"]}},` +
+				`{"name":[{"service":"user.v1.UserService"}],"timeout":"10s","retryPolicy":{"maxAttempts":2,"initialBackoff":"0.025s","maxBackoff":"0.25s","backoffMultiplier":2,"retryableStatusCodes":["UNAVAILABLE"]}},` +
+				`{"name":[{}],"timeout":"10s"}]}`,
+		},
+
+		{
+			name: "defaultRoute",
+			routerEntry: &consul.ServiceRouterConfigEntry{
+				Name: "user-service",
+				Routes: []consul.ServiceRoute{
+					{
+						Match:       &consul.ServiceRouteMatch{HTTP: &consul.ServiceRouteHTTPMatch{PathPrefix: "/"}},
+						Destination: &consul.ServiceRouteDestination{NumRetries: 1},
+					},
+				},
+			},
+			want: `{"methodConfig":[{"name":[{}],"retryPolicy":{"maxAttempts":2,"initialBackoff":"0.025s","maxBackoff":"0.25s","backoffMultiplier":2,"retryableStatusCodes":["UNAVAILABLE"]}}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			js, err := serviceConfigFromConfigEntries(testLogger, "user-service", tt.resolverEntry, tt.routerEntry)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if js != tt.want {
+				t.Errorf("generated service config:\n%s\nexpected:\n%s", js, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceConfigFromConfigEntriesIsReported(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	health.SetRespEntries([]*consul.ServiceEntry{
+		{
+			Service: &consul.AgentService{
+				Address: "localhost",
+				Port:    5678,
+			},
+		},
+	})
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	configEntries := mocks.NewConsulConfigEntriesClient()
+	configEntries.SetEntries(consul.ServiceResolver,
+		&consul.ServiceResolverConfigEntry{
+			Kind:         consul.ServiceResolver,
+			Name:         "other-service",
+			LoadBalancer: &consul.LoadBalancer{Policy: "least_request"},
+			ModifyIndex:  1,
+		},
+		&consul.ServiceResolverConfigEntry{
+			Kind:         consul.ServiceResolver,
+			Name:         "user-service",
+			LoadBalancer: &consul.LoadBalancer{Policy: "round_robin"},
+			ModifyIndex:  2,
+		},
+	)
+	t.Cleanup(replaceCreateConfigEntriesClientFn(
+		func(*consul.Config) (consulConfigEntriesEndpoint, error) {
+			return configEntries, nil
+		},
+	))
+
+	cc := mocks.NewClientConn()
+	target := resolver.Target{URL: url.URL{Path: "user-service", RawQuery: "serviceConfigFromConfigEntries=true"}}
+
+	r, err := NewBuilder().Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	waitFor(t, func() bool { return cc.UpdateStateCallCnt() > 0 }, "UpdateState was not called")
+
+	const want = `{"loadBalancingConfig":[{"round_robin":{}}]}`
+	if cc.ServiceConfigJSON() != want {
+		t.Errorf("first reported service config is %q, expected: %q", cc.ServiceConfigJSON(), want)
+	}
+
+	configEntries.SetEntries(consul.ServiceRouter,
+		&consul.ServiceRouterConfigEntry{
+			Kind: consul.ServiceRouter,
+			Name: "user-service",
+			Routes: []consul.ServiceRoute{
+				{Destination: &consul.ServiceRouteDestination{RequestTimeout: time.Second}},
+			},
+			ModifyIndex: 3,
+		},
+	)
+
+	waitForServiceConfig(t, cc, `{"loadBalancingConfig":[{"round_robin":{}}],"methodConfig":[{"name":[{}],"timeout":"1s"}]}`)
+
+	configEntries.SetEntries(consul.ServiceResolver)
+	configEntries.SetEntries(consul.ServiceRouter)
+
+	waitForServiceConfig(t, cc, "")
+}
@@ -0,0 +1,54 @@
+package consul
+
+import "time"
+
+// defaultDebounceMaxDelayFactor is the factor of the debounce duration that
+// is used as max delay, if none is configured.
+const defaultDebounceMaxDelayFactor = 5
+
+// debounceUpdate schedules reporting c.lastReporterState to
+// [c.cc.UpdateState] after no further update happened for the debounce
+// duration. Updates are delayed at most for debounceMaxDelay since the first
+// pending update.
+// c.mutex must be held when calling the method.
+func (c *consulResolver) debounceUpdate() {
+	now := c.clock.Now()
+
+	if c.debounceTimer == nil {
+		c.debouncePendingSince = now
+	} else {
+		c.debounceTimer.Stop()
+	}
+
+	delay := min(c.opts.debounce, c.debouncePendingSince.Add(c.opts.debounceMaxDelay).Sub(now))
+	c.debounceDeadline = now.Add(delay)
+	c.debounceTimer = c.clock.AfterFunc(delay, c.debounceExpired)
+}
+
+// debounceExpired reports the pending state update.
+func (c *consulResolver) debounceExpired() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.ctx.Err() != nil ||
+		c.debounceTimer == nil ||
+		c.clock.Now().Before(c.debounceDeadline) {
+		// the update was reported or rescheduled in the meantime
+		return
+	}
+
+	c.sendState()
+}
+
+// stopDebounce discards the pending state update.
+// c.mutex must be held when calling the method.
+func (c *consulResolver) stopDebounce() {
+	if c.debounceTimer == nil {
+		return
+	}
+
+	c.debounceTimer.Stop()
+	c.debounceTimer = nil
+	c.debouncePendingSince = time.Time{}
+	c.debounceDeadline = time.Time{}
+}
@@ -0,0 +1,111 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+func newDebounceTestResolver(t *testing.T, rawQuery string) (*consulResolver, *mocks.ClientConn, *mocks.Clock) {
+	t.Helper()
+
+	opts, err := parseEndpoint(&url.URL{Path: "user-service", RawQuery: rawQuery})
+	if err != nil {
+		t.Fatal("parseEndpoint() failed:", err)
+	}
+
+	clock := mocks.NewClock()
+	opts.clock = clock
+
+	cc := mocks.NewClientConn()
+	r, err := newConsulResolver(cc, "", opts)
+	if err != nil {
+		t.Fatal("newConsulResolver() failed:", err)
+	}
+
+	r.serviceConfigLoaded = true
+
+	return r, cc, clock
+}
+
+func endpointsWithAddrs(addrs ...string) []resolver.Endpoint {
+	result := make([]resolver.Endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		result = append(result, resolver.Endpoint{Addresses: []resolver.Address{{Addr: addr}}})
+	}
+
+	return result
+}
+
+func TestDebounce(t *testing.T) {
+	r, cc, clock := newDebounceTestResolver(t, "debounce=1s&debounceMaxDelay=3s")
+	svc := r.services[0]
+
+	if _, sent := r.reportEndpoints(svc, endpointsWithAddrs("10.0.0.1:1")); !sent {
+		t.Error("reportEndpoints() returned sent false for the first state")
+	}
+	if cnt := cc.UpdateStateCallCnt(); cnt != 1 {
+		t.Fatalf("first state was not reported immediately, UpdateState call count is %d", cnt)
+	}
+
+	if updated, sent := r.reportEndpoints(svc, endpointsWithAddrs("10.0.0.1:1", "10.0.0.2:1")); !updated || sent {
+		t.Errorf("reportEndpoints() returned updated %t and sent %t for a debounced update, expected true and false", updated, sent)
+	}
+	clock.Advance(500 * time.Millisecond)
+	r.reportEndpoints(svc, endpointsWithAddrs("10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1"))
+	clock.Advance(999 * time.Millisecond)
+
+	if cnt := cc.UpdateStateCallCnt(); cnt != 1 {
+		t.Fatalf("UpdateState was called %d times before the quiet period passed, expected 1", cnt)
+	}
+
+	clock.Advance(time.Millisecond)
+
+	if cnt := cc.UpdateStateCallCnt(); cnt != 2 {
+		t.Fatalf("UpdateState was called %d times after the quiet period passed, expected 2", cnt)
+	}
+
+	want := []resolver.Address{{Addr: "10.0.0.1:1"}, {Addr: "10.0.0.2:1"}, {Addr: "10.0.0.3:1"}}
+	if !cmpAddrs(cc.Addrs(), want) {
+		t.Errorf("reported addresses are %+v, expected %+v", cc.Addrs(), want)
+	}
+
+	t.Run("maxDelay", func(t *testing.T) {
+		for i := range 5 {
+			r.reportEndpoints(svc, endpointsWithAddrs("10.0.0.1:1", fmt.Sprintf("10.0.1.%d:1", i)))
+			clock.Advance(700 * time.Millisecond)
+		}
+
+		// the first update happened 3.5s ago, it must have been
+		// reported after 3s
+		if cnt := cc.UpdateStateCallCnt(); cnt != 3 {
+			t.Errorf("UpdateState was called %d times with updates in intervals shorter than the quiet period, expected 3", cnt)
+		}
+	})
+
+	t.Run("errorsAreReportedImmediately", func(t *testing.T) {
+		r.reportEndpoints(svc, endpointsWithAddrs("10.0.0.4:1"))
+		updateStateCnt := cc.UpdateStateCallCnt()
+
+		r.reportError(svc, errors.New("connection refused"))
+		if cnt := cc.ReportErrorCallCnt(); cnt != 1 {
+			t.Fatalf("ReportError was called %d times, expected 1", cnt)
+		}
+
+		clock.Advance(time.Minute)
+		if cnt := cc.UpdateStateCallCnt(); cnt != updateStateCnt {
+			t.Errorf("pending update was reported after an error")
+		}
+
+		r.reportEndpoints(svc, endpointsWithAddrs("10.0.0.5:1"))
+		if cnt := cc.UpdateStateCallCnt(); cnt != updateStateCnt+1 {
+			t.Errorf("first state after an error was not reported immediately")
+		}
+	})
+}
@@ -0,0 +1,273 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/miekg/dns"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/clock"
+)
+
+// transport defines how the resolver retrieves the instances of a service.
+type transport int
+
+const (
+	transportUndefined transport = iota
+	transportHTTP
+	transportDNS
+)
+
+const (
+	// defaultDNSServer is the address of the DNS server of the Consul
+	// agent with the default configuration.
+	defaultDNSServer = "127.0.0.1:8600"
+	// dnsDefaultPollInterval is the interval in that the DNS records are
+	// queried when they have a TTL of 0, which is the default of Consul
+	// for service records.
+	dnsDefaultPollInterval = 5 * time.Second
+	// dnsMinPollInterval is the minimum interval in that DNS records are
+	// queried.
+	dnsMinPollInterval = time.Second
+)
+
+// dnsHealthEndpoint is a consulHealthEndpoint that resolves services via the
+// DNS interface of Consul.
+// It retrieves the SRV records of the service and synthesizes service entries
+// from them.
+// Blocking queries are emulated by waiting for the TTL of the previous
+// response before the records are queried again.
+type dnsHealthEndpoint struct {
+	server     string
+	datacenter string
+	timeout    time.Duration
+	clock      clock.Clock
+	log        *slog.Logger
+
+	// mutex protects lastResults
+	mutex       sync.Mutex
+	lastResults map[string]*dnsResult
+}
+
+// dnsResult is the result of the last query for a DNS name.
+type dnsResult struct {
+	addrs    []string
+	index    uint64
+	interval time.Duration
+}
+
+func newDNSHealthEndpoint(server, datacenter string, clk clock.Clock, log *slog.Logger) *dnsHealthEndpoint {
+	if server == "" {
+		server = defaultDNSServer
+	}
+
+	return &dnsHealthEndpoint{
+		server:      server,
+		datacenter:  datacenter,
+		timeout:     5 * time.Second,
+		clock:       clk,
+		log:         log,
+		lastResults: map[string]*dnsResult{},
+	}
+}
+
+// srvName returns the name of the SRV records of service.
+// Consul DNS supports filtering by one tag.
+func (d *dnsHealthEndpoint) srvName(service string, tags []string) string {
+	var sb strings.Builder
+
+	if len(tags) > 0 {
+		sb.WriteString(tags[0])
+		sb.WriteByte('.')
+	}
+
+	sb.WriteString(service)
+	sb.WriteString(".service.")
+
+	if d.datacenter != "" {
+		sb.WriteString(d.datacenter)
+		sb.WriteByte('.')
+	}
+
+	sb.WriteString("consul.")
+
+	return sb.String()
+}
+
+// ServiceMultipleTags returns the instances of the service, resolved via the
+// SRV records of the service.
+// Consul DNS only returns instances that are not critical, passingOnly is
+// ignored.
+// If q.WaitIndex is not 0 and equals the index of the previous result, the
+// call blocks for the TTL of the previous response.
+func (d *dnsHealthEndpoint) ServiceMultipleTags(service string, tags []string, _ bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	name := d.srvName(service, tags)
+
+	d.mutex.Lock()
+	last := d.lastResults[name]
+	d.mutex.Unlock()
+
+	if last != nil && q.WaitIndex != 0 && q.WaitIndex == last.index {
+		select {
+		case <-q.Context().Done():
+			return nil, nil, q.Context().Err()
+		case <-d.clock.After(last.interval):
+		}
+	}
+
+	entries, ttl, err := d.lookupSRV(q.Context(), name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	interval := dnsDefaultPollInterval
+	if ttl != 0 {
+		interval = max(ttl, dnsMinPollInterval)
+	}
+
+	addrs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		addrs = append(addrs, net.JoinHostPort(e.Service.Address, fmt.Sprint(e.Service.Port)))
+	}
+	slices.Sort(addrs)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	result := d.lastResults[name]
+	if result == nil {
+		result = &dnsResult{}
+		d.lastResults[name] = result
+	}
+
+	if result.index == 0 || !slices.Equal(result.addrs, addrs) {
+		result.index++
+		result.addrs = addrs
+	}
+	result.interval = interval
+
+	return entries, &consul.QueryMeta{LastIndex: result.index}, nil
+}
+
+// lookupSRV queries the SRV records with name and returns a service entry for
+// each of them, together with the smallest TTL of the records.
+// The addresses of the SRV targets are taken from the additional section of
+// the response, if they are missing they are queried.
+func (d *dnsHealthEndpoint) lookupSRV(ctx context.Context, name string) ([]*consul.ServiceEntry, time.Duration, error) {
+	resp, err := d.exchange(ctx, name, dns.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.Rcode == dns.RcodeNameError {
+		return []*consul.ServiceEntry{}, 0, nil
+	}
+
+	var ttl uint32
+	targetAddrs := map[string]string{}
+
+	for _, rr := range resp.Extra {
+		switch r := rr.(type) {
+		case *dns.A:
+			if _, exists := targetAddrs[r.Hdr.Name]; !exists {
+				targetAddrs[r.Hdr.Name] = r.A.String()
+			}
+		case *dns.AAAA:
+			if _, exists := targetAddrs[r.Hdr.Name]; !exists {
+				targetAddrs[r.Hdr.Name] = r.AAAA.String()
+			}
+		}
+	}
+
+	entries := make([]*consul.ServiceEntry, 0, len(resp.Answer))
+	for _, rr := range resp.Answer {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+
+		if ttl == 0 || srv.Hdr.Ttl < ttl {
+			ttl = srv.Hdr.Ttl
+		}
+
+		addr, exists := targetAddrs[srv.Target]
+		if !exists {
+			addr, err = d.lookupHost(ctx, srv.Target)
+			if err != nil {
+				d.log.Warn("ignoring SRV record", "name", name, "srv_target", srv.Target, errAttr(err))
+				continue
+			}
+		}
+
+		entries = append(entries, &consul.ServiceEntry{
+			Node: &consul.Node{
+				Node:    strings.TrimSuffix(srv.Target, "."),
+				Address: addr,
+			},
+			Service: &consul.AgentService{
+				Address: addr,
+				Port:    int(srv.Port),
+			},
+		})
+	}
+
+	return entries, time.Duration(ttl) * time.Second, nil
+}
+
+// lookupHost returns the first IPv4 or IPv6 address of name.
+func (d *dnsHealthEndpoint) lookupHost(ctx context.Context, name string) (string, error) {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := d.exchange(ctx, name, qtype)
+		if err != nil {
+			return "", err
+		}
+
+		for _, rr := range resp.Answer {
+			switch r := rr.(type) {
+			case *dns.A:
+				return r.A.String(), nil
+			case *dns.AAAA:
+				return r.AAAA.String(), nil
+			}
+		}
+	}
+
+	return "", errors.New("no A or AAAA record found")
+}
+
+// exchange sends a query for name to the DNS server, when the UDP response is
+// truncated the query is repeated via TCP.
+func (d *dnsHealthEndpoint) exchange(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+
+	for _, network := range []string{"udp", "tcp"} {
+		clt := dns.Client{Net: network, Timeout: d.timeout}
+
+		resp, _, err := clt.ExchangeContext(ctx, msg, d.server)
+		if err != nil {
+			return nil, fmt.Errorf("querying %s records of %s from %s failed: %w", dns.TypeToString[qtype], name, d.server, err)
+		}
+
+		if resp.Truncated && network == "udp" {
+			continue
+		}
+
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			return nil, fmt.Errorf("querying %s records of %s from %s failed: %s", dns.TypeToString[qtype], name, d.server, dns.RcodeToString[resp.Rcode])
+		}
+
+		return resp, nil
+	}
+
+	// unreachable, the TCP response is never truncated
+	return nil, errors.New("dns response is truncated")
+}
@@ -0,0 +1,219 @@
+package consul
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+// testDNSServer is an in-process DNS server that answers SRV, A and AAAA
+// queries like the Consul DNS interface.
+type testDNSServer struct {
+	mutex sync.Mutex
+	// srv contains the SRV records by name, extra the additional records
+	// that are returned with them.
+	srv   map[string][]dns.RR
+	extra map[string][]dns.RR
+	hosts map[string][]dns.RR
+
+	addr string
+}
+
+func startTestDNSServer(t *testing.T) *testDNSServer {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen failed:", err)
+	}
+
+	s := &testDNSServer{
+		srv:   map[string][]dns.RR{},
+		extra: map[string][]dns.RR{},
+		hosts: map[string][]dns.RR{},
+		addr:  pc.LocalAddr().String(),
+	}
+
+	srv := dns.Server{PacketConn: pc, Handler: s}
+
+	go func() {
+		_ = srv.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = srv.Shutdown()
+	})
+
+	return s
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal("parsing RR failed:", err)
+	}
+
+	return rr
+}
+
+// SetSRV sets the SRV records and additional records that are returned for
+// name.
+func (s *testDNSServer) SetSRV(name string, srv, extra []dns.RR) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.srv[name] = srv
+	s.extra[name] = extra
+}
+
+// SetHost sets the A or AAAA records that are returned for name.
+func (s *testDNSServer) SetHost(name string, rrs ...dns.RR) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.hosts[name] = rrs
+}
+
+func (s *testDNSServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	q := req.Question[0]
+
+	switch q.Qtype {
+	case dns.TypeSRV:
+		srv, exists := s.srv[q.Name]
+		if !exists {
+			resp.Rcode = dns.RcodeNameError
+			break
+		}
+
+		resp.Answer = srv
+		resp.Extra = s.extra[q.Name]
+
+	default:
+		for _, rr := range s.hosts[q.Name] {
+			if rr.Header().Rrtype == q.Qtype {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+	}
+
+	_ = w.WriteMsg(resp)
+}
+
+func TestResolveViaDNS(t *testing.T) {
+	const name = "primary.user-service.service.dc2.consul."
+
+	server := startTestDNSServer(t)
+	server.SetSRV(name,
+		[]dns.RR{
+			mustRR(t, name+" 1 IN SRV 1 1 8080 node1.node.dc2.consul."),
+			mustRR(t, name+" 1 IN SRV 1 1 8081 node2.node.dc2.consul."),
+		},
+		[]dns.RR{
+			mustRR(t, "node1.node.dc2.consul. 1 IN A 10.0.0.1"),
+		},
+	)
+	// node2 is not contained in the additional section and is looked up
+	// separately
+	server.SetHost("node2.node.dc2.consul.", mustRR(t, "node2.node.dc2.consul. 1 IN AAAA fd00::2"))
+
+	cc := mocks.NewClientConn()
+	target := resolver.Target{URL: url.URL{
+		Host:     server.addr,
+		Path:     "user-service",
+		RawQuery: "transport=dns&tags=primary&dc=dc2",
+	}}
+
+	r, err := NewBuilder().Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	waitForAddrs(t, cc, []resolver.Address{
+		{Addr: "10.0.0.1:8080"},
+		{Addr: "[fd00::2]:8081"},
+	})
+
+	t.Run("changedRecordsAreResolvedAfterTTL", func(t *testing.T) {
+		server.SetSRV(name,
+			[]dns.RR{mustRR(t, name+" 1 IN SRV 1 1 8080 node3.node.dc2.consul.")},
+			[]dns.RR{mustRR(t, "node3.node.dc2.consul. 1 IN A 10.0.0.3")},
+		)
+
+		waitForAddrs(t, cc, []resolver.Address{{Addr: "10.0.0.3:8080"}})
+	})
+}
+
+func TestResolveViaDNSUnknownService(t *testing.T) {
+	server := startTestDNSServer(t)
+
+	cc := mocks.NewClientConn()
+	target := resolver.Target{URL: url.URL{Host: server.addr, Path: "user-service", RawQuery: "transport=dns"}}
+
+	r, err := NewBuilder().Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	waitFor(t, func() bool { return cc.UpdateStateCallCnt() > 0 }, "UpdateState was not called")
+
+	if len(cc.Addrs()) != 0 {
+		t.Errorf("resolved addresses %+v for an unknown service, expected none", cc.Addrs())
+	}
+}
+
+func TestDNSPollIntervalUsesClock(t *testing.T) {
+	const name = "user-service.service.consul."
+
+	server := startTestDNSServer(t)
+	server.SetSRV(name,
+		[]dns.RR{mustRR(t, name+" 5 IN SRV 1 1 8080 node1.node.dc1.consul.")},
+		[]dns.RR{mustRR(t, "node1.node.dc1.consul. 5 IN A 10.0.0.1")},
+	)
+
+	clk := mocks.NewClock()
+	d := newDNSHealthEndpoint(server.addr, "", clk, testLogger)
+
+	_, meta, err := d.ServiceMultipleTags("user-service", nil, false, &consul.QueryOptions{})
+	if err != nil {
+		t.Fatal("ServiceMultipleTags() failed:", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _, _ = d.ServiceMultipleTags("user-service", nil, false, &consul.QueryOptions{WaitIndex: meta.LastIndex})
+	}()
+
+	clk.WaitForTimers(1)
+
+	select {
+	case <-done:
+		t.Fatal("query with the unchanged index returned before the TTL passed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clk.Advance(5 * time.Second)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("query did not return after the TTL passed")
+	}
+}
@@ -0,0 +1,94 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrorPolicy defines how the resolver handles failed Consul queries.
+type ErrorPolicy int
+
+const (
+	// ErrorPolicyReportError discards the addresses of a service when
+	// querying it fails. If no service can be resolved, the error is
+	// reported to the ClientConn.
+	ErrorPolicyReportError ErrorPolicy = iota + 1
+	// ErrorPolicyKeepLastState keeps the last resolved addresses of a
+	// service when querying it fails, until the failures last longer
+	// than the grace period. Then the addresses are discarded like with
+	// [ErrorPolicyReportError].
+	ErrorPolicyKeepLastState
+)
+
+// defaultErrorGracePeriod is the duration for that the last state is kept
+// with [ErrorPolicyKeepLastState], if none is configured.
+const defaultErrorGracePeriod = 5 * time.Minute
+
+func parseErrorPolicy(s string) (ErrorPolicy, error) {
+	switch strings.ToLower(s) {
+	case "reporterror":
+		return ErrorPolicyReportError, nil
+	case "keeplaststate":
+		return ErrorPolicyKeepLastState, nil
+	default:
+		return 0, fmt.Errorf("unsupported onError parameter value: '%s'", s)
+	}
+}
+
+// startGracePeriod starts the grace period of svc, if it is not running
+// already. When it expires, the endpoints of svc are discarded.
+// c.mutex must be held when calling the method.
+func (c *consulResolver) startGracePeriod(svc *serviceWatcher) {
+	if svc.gracePeriodTimer != nil {
+		return
+	}
+
+	svc.log.Warn("resolving service failed, keeping its last resolved addresses",
+		"grace_period", c.opts.errorGracePeriod,
+		errAttr(svc.err),
+	)
+
+	svc.failingSince = c.clock.Now()
+	svc.gracePeriodTimer = c.clock.AfterFunc(c.opts.errorGracePeriod, func() {
+		c.gracePeriodExpired(svc)
+	})
+}
+
+// gracePeriodExpired discards the endpoints of svc and reports the errors,
+// if svc is still failing.
+func (c *consulResolver) gracePeriodExpired(svc *serviceWatcher) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.ctx.Err() != nil ||
+		svc.gracePeriodTimer == nil ||
+		c.clock.Since(svc.failingSince) < c.opts.errorGracePeriod {
+		// svc was resolved successfully in the meantime
+		return
+	}
+
+	svc.log.Warn("resolving service failed for longer than the grace period, discarding its addresses",
+		"grace_period", c.opts.errorGracePeriod,
+	)
+
+	svc.gracePeriodTimer = nil
+	svc.failingSince = time.Time{}
+	svc.resolved = false
+	svc.endpoints = nil
+	svc.stopShrinkHold()
+
+	c.reportErrors()
+}
+
+// stopGracePeriod stops the grace period of s.
+// consulResolver.mutex must be held when calling the method.
+func (s *serviceWatcher) stopGracePeriod() {
+	if s.gracePeriodTimer == nil {
+		return
+	}
+
+	s.gracePeriodTimer.Stop()
+	s.gracePeriodTimer = nil
+	s.failingSince = time.Time{}
+}
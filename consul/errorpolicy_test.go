@@ -0,0 +1,92 @@
+package consul
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+func TestKeepLastStateOnError(t *testing.T) {
+	const gracePeriod = time.Minute
+
+	health := mocks.NewConsulHealthClient()
+	health.SetRespServiceEntries([]*consul.AgentService{
+		{Address: "10.0.0.1", Port: 1},
+	})
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	cc := mocks.NewClientConn()
+	clk := mocks.NewClock()
+	target := resolver.Target{URL: url.URL{Path: "user-service"}}
+
+	r, err := NewBuilder(withClock(clk), WithErrorPolicy(ErrorPolicyKeepLastState, gracePeriod)).
+		Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	want := []resolver.Address{{Addr: "10.0.0.1:1"}}
+	waitForAddrs(t, cc, want)
+
+	// the mock responds with the same index, the watcher delays the next
+	// query because it returned too fast
+	clk.WaitForTimers(1)
+
+	health.SetRespError(errors.New("connection refused"))
+	clk.Advance(50 * time.Millisecond)
+
+	// the grace period and the retry timer
+	clk.WaitForTimers(2)
+	clk.Advance(gracePeriod - time.Millisecond)
+
+	if cnt := cc.ReportErrorCallCnt(); cnt != 0 || !cmpAddrs(cc.Addrs(), want) {
+		t.Fatalf("ReportError was called %d times and the addresses changed to %+v during the grace period", cnt, cc.Addrs())
+	}
+
+	clk.Advance(time.Millisecond)
+	waitFor(t, func() bool { return cc.ReportErrorCallCnt() > 0 }, "ReportError was not called after the grace period expired")
+
+	t.Run("recoveryEndsGracePeriod", func(t *testing.T) {
+		c := r.(*consulResolver)
+
+		updateStateCallCnt := cc.UpdateStateCallCnt()
+		health.SetRespError(nil)
+		r.ResolveNow(resolver.ResolveNowOptions{})
+		waitFor(t, func() bool { return cc.UpdateStateCallCnt() > updateStateCallCnt }, "UpdateState was not called after the service recovered")
+
+		reportErrorCallCnt := cc.ReportErrorCallCnt()
+
+		clk.WaitForTimers(1)
+		health.SetRespError(errors.New("connection refused"))
+		clk.Advance(50 * time.Millisecond)
+
+		clk.WaitForTimers(2)
+		clk.Advance(gracePeriod / 2)
+
+		health.SetRespError(nil)
+		r.ResolveNow(resolver.ResolveNowOptions{})
+		waitFor(t, func() bool {
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+
+			return c.services[0].gracePeriodTimer == nil
+		}, "grace period did not end when the service recovered")
+
+		clk.Advance(gracePeriod)
+
+		if cnt := cc.ReportErrorCallCnt() - reportErrorCallCnt; cnt != 0 {
+			t.Errorf("ReportError was called %d times after the service recovered within the grace period", cnt)
+		}
+	})
+}
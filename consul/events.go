@@ -0,0 +1,187 @@
+package consul
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// Event is passed to the handler registered via [WithEventHandler].
+// It is one of [AddressesChanged], [ResolutionFailed], [Recovered] and
+// [WaitIndexReset].
+type Event interface {
+	isEvent()
+}
+
+// AddressesChanged is emitted when addresses that differ from the previous
+// ones are reported to gRPC.
+type AddressesChanged struct {
+	// Target is the URL of the resolver target.
+	Target string
+	// Added and Removed are the addresses that were added and removed,
+	// compared to the previous reported addresses.
+	Added   []string
+	Removed []string
+}
+
+// ResolutionFailed is emitted when querying the instances of a service
+// failed.
+type ResolutionFailed struct {
+	Target  string
+	Service string
+	Err     error
+	// RetryIn is the delay after that the query is retried.
+	RetryIn time.Duration
+}
+
+// Recovered is emitted when querying the instances of a service succeeded
+// after it failed before.
+type Recovered struct {
+	Target  string
+	Service string
+}
+
+// WaitIndexReset is emitted when Consul responded with a smaller index than
+// in the previous query of a service and the blocking query loop is
+// restarted.
+type WaitIndexReset struct {
+	Target        string
+	Service       string
+	Index         uint64
+	PreviousIndex uint64
+}
+
+func (AddressesChanged) isEvent() {}
+func (ResolutionFailed) isEvent() {}
+func (Recovered) isEvent()        {}
+func (WaitIndexReset) isEvent()   {}
+
+// maxQueuedEvents is the number of events that are queued for a handler,
+// further events are dropped until the handler caught up.
+const maxQueuedEvents = 1024
+
+// eventDispatcher passes events asynchronously and in order to a handler.
+// A slow handler does not block the resolver, events that exceed
+// maxQueuedEvents are dropped and counted.
+type eventDispatcher struct {
+	handler func(Event)
+	log     *slog.Logger
+
+	// mutex protects queue and dropped, the number of events that were
+	// dropped since the handler was called last.
+	mutex   sync.Mutex
+	queue   []Event
+	dropped int
+	notify  chan struct{}
+}
+
+func newEventDispatcher(handler func(Event), log *slog.Logger) *eventDispatcher {
+	return &eventDispatcher{
+		handler: handler,
+		log:     log,
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// emit queues e for the handler. If d is nil, the event is discarded.
+// If maxQueuedEvents are queued, e is dropped.
+func (d *eventDispatcher) emit(e Event) {
+	if d == nil {
+		return
+	}
+
+	d.mutex.Lock()
+	if len(d.queue) < maxQueuedEvents {
+		d.queue = append(d.queue, e)
+	} else {
+		d.dropped++
+	}
+	d.mutex.Unlock()
+
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run passes the queued events to the handler until ctx is canceled.
+// Events that are queued when ctx is canceled are discarded.
+func (d *eventDispatcher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.notify:
+		}
+
+		d.mutex.Lock()
+		events, dropped := d.queue, d.dropped
+		d.queue, d.dropped = nil, 0
+		d.mutex.Unlock()
+
+		if dropped > 0 {
+			d.log.Warn("event handler is too slow, events were dropped", "dropped", dropped)
+		}
+
+		for _, e := range events {
+			if ctx.Err() != nil {
+				return
+			}
+
+			d.handler(e)
+		}
+	}
+}
+
+// addressesDiff returns the elements of addrs that are not in prev and the
+// elements of prev that are not in addrs.
+func addressesDiff(prev, addrs []string) (added, removed []string) {
+	for _, a := range addrs {
+		if !slices.Contains(prev, a) {
+			added = append(added, a)
+		}
+	}
+
+	for _, a := range prev {
+		if !slices.Contains(addrs, a) {
+			removed = append(removed, a)
+		}
+	}
+
+	return added, removed
+}
+
+// addressesChanged logs the difference between addrs and the previous
+// reported addresses and emits an [AddressesChanged] event, if they differ.
+// c.mutex must be held when calling the method.
+func (c *consulResolver) addressesChanged(addrs []resolver.Address) {
+	cur := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		cur = append(cur, a.Addr)
+	}
+
+	added, removed := addressesDiff(c.reportedAddrs, cur)
+	c.reportedAddrs = cur
+
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	c.log.Info("addresses changed",
+		"added", added,
+		"removed", removed,
+		"addr_count", len(cur),
+	)
+
+	c.recordAddressChange(added, removed)
+
+	c.events.emit(AddressesChanged{
+		Target:  c.target,
+		Added:   added,
+		Removed: removed,
+	})
+}
@@ -0,0 +1,225 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+func waitForEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+
+	var e Event
+	waitFor(t, func() bool {
+		select {
+		case e = <-events:
+			return true
+		default:
+			return false
+		}
+	}, "no event was received")
+
+	return e
+}
+
+func TestEvents(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	health.SetRespError(errors.New("connection refused"))
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	events := make(chan Event, 16)
+	cc := mocks.NewClientConn()
+	clk := mocks.NewClock()
+	target := resolver.Target{URL: url.URL{Scheme: "consul", Path: "/user-service"}}
+
+	r, err := NewBuilder(withClock(clk), WithEventHandler(func(e Event) { events <- e })).
+		Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	failed, ok := waitForEvent(t, events).(ResolutionFailed)
+	if !ok {
+		t.Fatalf("first event is %T, expected ResolutionFailed", failed)
+	}
+	if failed.Target != "consul:///user-service" || failed.Service != "user-service" ||
+		failed.Err == nil || failed.RetryIn <= 0 {
+		t.Errorf("unexpected ResolutionFailed event: %+v", failed)
+	}
+
+	health.SetRespError(nil)
+	health.SetRespServiceEntries([]*consul.AgentService{
+		{Address: "10.0.0.1", Port: 1},
+		{Address: "10.0.0.2", Port: 1},
+	})
+	clk.Advance(time.Minute)
+
+	if e := waitForEvent(t, events); !reflect.DeepEqual(e, Recovered{Target: "consul:///user-service", Service: "user-service"}) {
+		t.Errorf("unexpected event %+v, expected Recovered", e)
+	}
+
+	want := AddressesChanged{Target: "consul:///user-service", Added: []string{"10.0.0.1:1", "10.0.0.2:1"}}
+	if e := waitForEvent(t, events); !reflect.DeepEqual(e, want) {
+		t.Errorf("unexpected event %+v, expected %+v", e, want)
+	}
+
+	health.SetRespServiceEntries([]*consul.AgentService{
+		{Address: "10.0.0.2", Port: 1},
+		{Address: "10.0.0.3", Port: 1},
+	})
+	// release the watcher that delays the next query because the mock
+	// responded too fast with unchanged data
+	clk.Advance(time.Minute)
+
+	want = AddressesChanged{
+		Target:  "consul:///user-service",
+		Added:   []string{"10.0.0.3:1"},
+		Removed: []string{"10.0.0.1:1"},
+	}
+	if e := waitForEvent(t, events); !reflect.DeepEqual(e, want) {
+		t.Errorf("unexpected event %+v, expected %+v", e, want)
+	}
+}
+
+func TestEventsDoNotContainToken(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	health.SetRespError(errors.New("connection refused"))
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	events := make(chan Event, 16)
+	cc := mocks.NewClientConn()
+	clk := mocks.NewClock()
+	target := resolver.Target{URL: url.URL{Scheme: "consul", Path: "/user-service", RawQuery: "token=secret"}}
+
+	r, err := NewBuilder(withClock(clk), WithEventHandler(func(e Event) { events <- e })).
+		Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	received := []Event{waitForEvent(t, events)}
+
+	health.SetRespError(nil)
+	health.SetRespServiceEntries([]*consul.AgentService{{Address: "10.0.0.1", Port: 1}})
+	clk.Advance(time.Minute)
+
+	received = append(received, waitForEvent(t, events), waitForEvent(t, events))
+
+	for _, e := range received {
+		if s := fmt.Sprintf("%+v", e); strings.Contains(s, "secret") {
+			t.Errorf("event %T contains the token: %s", e, s)
+		}
+	}
+}
+
+func TestSlowEventHandlerDoesNotBlockResolution(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	unblock := make(chan struct{})
+
+	cc := mocks.NewClientConn()
+	target := resolver.Target{URL: url.URL{Path: "user-service"}}
+
+	r, err := NewBuilder(WithEventHandler(func(Event) { <-unblock })).
+		Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+	// registered after r.Close to run before it, Close waits for the
+	// handler
+	t.Cleanup(func() { close(unblock) })
+
+	for i := range 3 {
+		health.SetRespServiceEntries([]*consul.AgentService{{Address: "10.0.0.1", Port: i + 1}})
+		r.ResolveNow(resolver.ResolveNowOptions{})
+
+		waitForAddrs(t, cc, []resolver.Address{{Addr: "10.0.0.1:" + strconv.Itoa(i+1)}})
+	}
+}
+
+func TestEventQueueIsBounded(t *testing.T) {
+	d := newEventDispatcher(func(Event) {}, testLogger)
+
+	for range maxQueuedEvents + 10 {
+		d.emit(Recovered{})
+	}
+
+	if len(d.queue) != maxQueuedEvents || d.dropped != 10 {
+		t.Errorf("%d events are queued and %d dropped, expected %d and 10", len(d.queue), d.dropped, maxQueuedEvents)
+	}
+}
+
+func TestCloseWaitsForEventHandler(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	health.SetRespError(errors.New("connection refused"))
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	called := make(chan struct{})
+	unblock := make(chan struct{})
+	var once sync.Once
+
+	r, err := NewBuilder(WithEventHandler(func(Event) {
+		once.Do(func() { close(called) })
+		<-unblock
+	})).Build(resolver.Target{URL: url.URL{Path: "user-service"}}, mocks.NewClientConn(), resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event handler was not called")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Close returned while the event handler is running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(unblock)
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return after the event handler returned")
+	}
+}
@@ -0,0 +1,85 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInitialResolveTimeout is reported when no addresses were
+	// retrieved from Consul within the initialResolveTimeout of the
+	// resolver. The reported error wraps it together with the reasons per
+	// service.
+	ErrInitialResolveTimeout = errors.New("no addresses resolved within initialResolveTimeout")
+	// ErrNoInstances is the reason for [ErrInitialResolveTimeout] when
+	// Consul was queried successfully but returned no instances of the
+	// service.
+	ErrNoInstances = errors.New("no instances found")
+)
+
+// startInitialResolveTimer starts the timer that reports
+// [ErrInitialResolveTimeout] when no addresses are resolved within the
+// initialResolveTimeout.
+func (c *consulResolver) startInitialResolveTimer() {
+	if c.opts.initialResolveTimeout == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.initialResolveTimer = c.clock.AfterFunc(c.opts.initialResolveTimeout, c.initialResolveTimeoutExpired)
+}
+
+// initialResolveTimeoutExpired reports [ErrInitialResolveTimeout] if no
+// addresses were resolved yet.
+func (c *consulResolver) initialResolveTimeoutExpired() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.ctx.Err() != nil || c.initialResolveTimer == nil {
+		return
+	}
+
+	c.initialResolveTimer = nil
+	c.initialResolveExpired = true
+
+	err := c.initialResolveError()
+	c.log.Error("resolving the target timed out", "timeout", c.opts.initialResolveTimeout, errAttr(err))
+	c.updateError(err)
+}
+
+// stopInitialResolveTimer stops the initial resolve timer, it is called when
+// addresses were retrieved from Consul.
+// c.mutex must be held when calling the method.
+func (c *consulResolver) stopInitialResolveTimer() {
+	c.initialResolveExpired = false
+
+	if c.initialResolveTimer != nil {
+		c.initialResolveTimer.Stop()
+		c.initialResolveTimer = nil
+	}
+}
+
+// initialResolveError returns an error that wraps [ErrInitialResolveTimeout]
+// and describes for each service why it was not resolved. Services whose
+// queries failed, that have no instances and whose queries did not complete
+// are distinguished.
+// c.mutex must be held when calling the method.
+func (c *consulResolver) initialResolveError() error {
+	errs := make([]error, 0, len(c.services))
+	for _, svc := range c.services {
+		switch {
+		case svc.err != nil:
+			errs = append(errs, fmt.Errorf("querying consul for service '%s' failed: %w", svc.name, svc.err))
+		case svc.resolved && svc.registration != nil && svc.registration.reason != nil:
+			errs = append(errs, fmt.Errorf("%w: %w", ErrNoInstances, svc.registration.reason))
+		case svc.resolved:
+			errs = append(errs, fmt.Errorf("service '%s': %w", svc.name, ErrNoInstances))
+		default:
+			errs = append(errs, fmt.Errorf("querying consul for service '%s' did not complete", svc.name))
+		}
+	}
+
+	return fmt.Errorf("%w: %w", ErrInitialResolveTimeout, errors.Join(errs...))
+}
@@ -0,0 +1,159 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/clock"
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+func TestInitialResolveTimeout(t *testing.T) {
+	tests := []struct {
+		name          string
+		respErr       error
+		wantNoInst    bool
+		wantErrSubstr string
+	}{
+		{
+			name:          "noInstances",
+			wantNoInst:    true,
+			wantErrSubstr: `no instances found: 0 of 2 instances of "user-service" are passing`,
+		},
+		{
+			name:          "queryFails",
+			respErr:       errors.New("connection refused"),
+			wantErrSubstr: "querying consul for service 'user-service' failed: connection refused",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			health := mocks.NewConsulHealthClient()
+			health.SetRespError(tt.respErr)
+			t.Cleanup(replaceCreateHealthClientFn(
+				func(*consul.Config) (consulHealthEndpoint, error) {
+					return health, nil
+				},
+			))
+
+			catalog := mocks.NewConsulCatalogClient()
+			catalog.SetServiceInstances("user-service", []*consul.CatalogService{{ServiceID: "1"}, {ServiceID: "2"}})
+			t.Cleanup(replaceCreateCatalogClientFn(
+				func(*consul.Config) (consulCatalogEndpoint, error) {
+					return catalog, nil
+				},
+			))
+
+			cc := mocks.NewClientConn()
+			clk := mocks.NewClock()
+			target := resolver.Target{URL: url.URL{Path: "user-service", RawQuery: "initialResolveTimeout=10s"}}
+
+			r, err := NewBuilder(withClock(clk)).Build(target, cc, resolver.BuildOptions{})
+			if err != nil {
+				t.Fatal("Build() failed:", err.Error())
+			}
+			t.Cleanup(r.Close)
+
+			waitFor(t, func() bool { return cc.ReportErrorCallCnt() > 0 }, "ReportError was not called")
+
+			clk.Advance(10 * time.Second)
+
+			err = cc.LastReportedError()
+			if !errors.Is(err, ErrInitialResolveTimeout) {
+				t.Fatalf("reported error is %v, expected ErrInitialResolveTimeout", err)
+			}
+
+			if errors.Is(err, ErrNoInstances) != tt.wantNoInst {
+				t.Errorf("errors.Is(%v, ErrNoInstances) is %t, expected %t", err, !tt.wantNoInst, tt.wantNoInst)
+			}
+
+			if !strings.Contains(err.Error(), tt.wantErrSubstr) {
+				t.Errorf("reported error %q does not contain %q", err, tt.wantErrSubstr)
+			}
+
+			health.SetRespError(nil)
+			health.SetRespServiceEntries([]*consul.AgentService{{Address: "10.0.0.1", Port: 1}})
+			clk.Advance(time.Minute)
+
+			waitForAddrs(t, cc, []resolver.Address{{Addr: "10.0.0.1:1"}})
+		})
+	}
+}
+
+func TestWaitForResolution(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	t.Cleanup(replaceCreateCatalogClientFn(
+		func(*consul.Config) (consulCatalogEndpoint, error) {
+			return mocks.NewConsulCatalogClient(), nil
+		},
+	))
+
+	t.Run("resolved", func(t *testing.T) {
+		health.SetRespError(nil)
+		health.SetRespServiceEntries([]*consul.AgentService{{Address: "10.0.0.1", Port: 1}})
+
+		addrs, err := WaitForResolution(context.Background(), "consul://localhost/user-service")
+		if err != nil {
+			t.Fatal("WaitForResolution() failed:", err)
+		}
+
+		if len(addrs) != 1 || addrs[0].Addr != "10.0.0.1:1" {
+			t.Errorf("WaitForResolution() returned %+v, expected [10.0.0.1:1]", addrs)
+		}
+	})
+
+	t.Run("contextDone", func(t *testing.T) {
+		health.SetRespError(errors.New("connection refused"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		_, err := WaitForResolution(ctx, "consul://localhost/user-service")
+		if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "connection refused") {
+			t.Errorf("WaitForResolution() returned error %v, expected deadline exceeded with the query error", err)
+		}
+	})
+
+	t.Run("cachedAddressesAreIgnored", func(t *testing.T) {
+		cacheDir := t.TempDir()
+		cache := newEndpointCache(cacheDir, "consul://localhost/user-service", time.Hour, clock.Real{}, testLogger)
+		err := cache.store([]resolver.Endpoint{{Addresses: []resolver.Address{{Addr: "10.0.0.1:1"}}}}, "")
+		if err != nil {
+			t.Fatal("storing addresses in the cache failed:", err)
+		}
+
+		health.SetRespError(errors.New("connection refused"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		addrs, err := WaitForResolution(ctx, "consul://localhost/user-service", WithCacheDir(cacheDir))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("WaitForResolution() returned %+v and error %v, expected deadline exceeded", addrs, err)
+		}
+	})
+
+	t.Run("initialResolveTimeout", func(t *testing.T) {
+		health.SetRespError(nil)
+		health.SetRespServiceEntries(nil)
+
+		_, err := WaitForResolution(context.Background(), "consul://localhost/user-service?initialResolveTimeout=50ms")
+		if !errors.Is(err, ErrInitialResolveTimeout) || !errors.Is(err, ErrNoInstances) {
+			t.Errorf("WaitForResolution() returned error %v, expected ErrInitialResolveTimeout with ErrNoInstances", err)
+		}
+	})
+}
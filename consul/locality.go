@@ -0,0 +1,107 @@
+package consul
+
+import (
+	"errors"
+
+	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+)
+
+// Locality describes where a service instance or client is located.
+type Locality struct {
+	Region string
+	Zone   string
+}
+
+// localityKey is the key of the [Locality] in [resolver.Address.BalancerAttributes],
+// [resolver.Endpoint.Attributes] and [resolver.State.Attributes].
+type localityKey struct{}
+
+// Equal returns true if l and o are the same locality.
+// It is used by [attributes.Attributes.Equal].
+func (l Locality) Equal(o any) bool {
+	ol, ok := o.(Locality)
+	return ok && l == ol
+}
+
+// IsZero returns true if neither the region nor the zone is set.
+func (l Locality) IsZero() bool {
+	return l == Locality{}
+}
+
+// LocalityFromAddress returns the locality of the service instance that the
+// resolver stored in the BalancerAttributes of addr.
+// It returns false if addr has no locality.
+func LocalityFromAddress(addr resolver.Address) (Locality, bool) {
+	l, ok := addr.BalancerAttributes.Value(localityKey{}).(Locality)
+	return l, ok
+}
+
+// LocalityFromState returns the locality of the client that the resolver
+// stored in the Attributes of state.
+// It returns false if state has no locality.
+func LocalityFromState(state resolver.State) (Locality, bool) {
+	l, ok := state.Attributes.Value(localityKey{}).(Locality)
+	return l, ok
+}
+
+// LocalityAttributes returns attributes that contain l.
+// They can be used as BalancerAttributes of addresses and Attributes of a
+// resolver state, e.g. to provide localities from other resolvers.
+func LocalityAttributes(l Locality) *attributes.Attributes {
+	return attributes.New(localityKey{}, l)
+}
+
+func withLocality(a *attributes.Attributes, l Locality) *attributes.Attributes {
+	if a == nil {
+		return LocalityAttributes(l)
+	}
+
+	return a.WithValue(localityKey{}, l)
+}
+
+// entryLocality returns the locality of the service entry.
+// The region and zone are read from the service metadata keys regionKey and
+// zoneKey, if a key does not exist in the service metadata it is looked up in
+// the node metadata.
+func entryLocality(e *consul.ServiceEntry, regionKey, zoneKey string) Locality {
+	lookup := func(key string) string {
+		if key == "" {
+			return ""
+		}
+
+		if v, exists := e.Service.Meta[key]; exists {
+			return v
+		}
+
+		if e.Node != nil {
+			return e.Node.Meta[key]
+		}
+
+		return ""
+	}
+
+	return Locality{Region: lookup(regionKey), Zone: lookup(zoneKey)}
+}
+
+// agentLocality returns the locality of the Consul agent, read from the node
+// metadata keys regionKey and zoneKey in the agent self response.
+func agentLocality(self map[string]map[string]interface{}, regionKey, zoneKey string) (Locality, error) {
+	meta, exists := self["Meta"]
+	if !exists {
+		return Locality{}, errors.New("agent self response contains no node metadata")
+	}
+
+	lookup := func(key string) string {
+		v, _ := meta[key].(string)
+		return v
+	}
+
+	l := Locality{Region: lookup(regionKey), Zone: lookup(zoneKey)}
+	if l.IsZero() {
+		return Locality{}, errors.New("node metadata of the agent contains no locality")
+	}
+
+	return l, nil
+}
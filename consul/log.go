@@ -0,0 +1,113 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// newLogger returns l, if it is nil a logger that writes to grpclog is
+// returned.
+func newLogger(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return slog.New(&grpclogHandler{})
+	}
+
+	return l
+}
+
+// grpclogHandler is a [slog.Handler] that writes records to the grpclog
+// component of the package. It is used when no logger is passed to the
+// builder.
+// Debug records are only written when the grpclog verbosity is at least 2.
+type grpclogHandler struct {
+	// attrs are the formatted attributes that were added via WithAttrs.
+	attrs string
+	// group is the prefix of the keys of the attributes, it is the dot
+	// separated list of the group names that were added via WithGroup.
+	group string
+}
+
+func (*grpclogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo || logger.V(2)
+}
+
+func (h *grpclogHandler) Handle(_ context.Context, r slog.Record) error {
+	var sb strings.Builder
+
+	sb.WriteString(r.Message)
+	sb.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&sb, h.group, a)
+		return true
+	})
+
+	switch {
+	case r.Level >= slog.LevelError:
+		logger.Error(sb.String())
+	case r.Level >= slog.LevelWarn:
+		logger.Warning(sb.String())
+	default:
+		logger.Info(sb.String())
+	}
+
+	return nil
+}
+
+func (h *grpclogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var sb strings.Builder
+
+	sb.WriteString(h.attrs)
+	for _, a := range attrs {
+		appendAttr(&sb, h.group, a)
+	}
+
+	return &grpclogHandler{attrs: sb.String(), group: h.group}
+}
+
+func (h *grpclogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	return &grpclogHandler{attrs: h.attrs, group: h.group + name + "."}
+}
+
+// appendAttr writes a in the format " key=value" to sb.
+func appendAttr(sb *strings.Builder, group string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		prefix := group
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+
+		for _, ga := range a.Value.Group() {
+			appendAttr(sb, prefix, ga)
+		}
+
+		return
+	}
+
+	s := a.Value.String()
+	if a.Value.Kind() == slog.KindAny {
+		s = fmt.Sprint(a.Value.Any())
+	}
+
+	if s == "" || strings.ContainsAny(s, " =\"") {
+		s = strconv.Quote(s)
+	}
+
+	fmt.Fprintf(sb, " %s%s=%s", group, a.Key, s)
+}
+
+// errAttr returns an attribute with the key error for err.
+func errAttr(err error) slog.Attr {
+	return slog.String("error", err.Error())
+}
@@ -0,0 +1,126 @@
+package consul
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+// testLogger is the logger that is passed to functions in tests, it writes
+// to grpclog.
+var testLogger = slog.New(&grpclogHandler{})
+
+// recordWriter passes each JSON log record that is written to it to a
+// channel. Records are discarded when the channel is full.
+type recordWriter chan map[string]any
+
+func (w recordWriter) Write(p []byte) (int, error) {
+	var rec map[string]any
+	if err := json.Unmarshal(p, &rec); err != nil {
+		return 0, err
+	}
+
+	select {
+	case w <- rec:
+	default:
+	}
+	return len(p), nil
+}
+
+func waitForLogRecord(t *testing.T, records <-chan map[string]any, msg string) map[string]any {
+	t.Helper()
+
+	var rec map[string]any
+	waitFor(t, func() bool {
+		select {
+		case rec = <-records:
+			return rec[slog.MessageKey] == msg
+		default:
+			return false
+		}
+	}, "no log record with message %q was written", msg)
+
+	return rec
+}
+
+func TestLoggerRecordsHaveAttributes(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	health.SetRespError(errors.New("connection refused"))
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	records := make(recordWriter, 256)
+	log := slog.New(slog.NewJSONHandler(records, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	cc := mocks.NewClientConn()
+	clk := mocks.NewClock()
+	target := resolver.Target{URL: url.URL{Scheme: "consul", Path: "/user-service", RawQuery: "dc=dc1&token=secret"}}
+
+	r, err := NewBuilder(withClock(clk), WithLogger(log)).
+		Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	rec := waitForLogRecord(t, records, "resolving service via consul failed, retrying")
+	if strings.Contains(rec["target"].(string), "secret") {
+		t.Errorf("target attribute contains the token: %q", rec["target"])
+	}
+	if rec["service"] != "user-service" || rec["dc"] != "dc1" {
+		t.Errorf("unexpected service or dc attributes in record: %+v", rec)
+	}
+	if rec["error"] != "connection refused" {
+		t.Errorf("error attribute is %q, expected %q", rec["error"], "connection refused")
+	}
+	if _, exists := rec["retry_in"]; !exists {
+		t.Errorf("record has no retry_in attribute: %+v", rec)
+	}
+
+	health.SetRespError(nil)
+	health.SetRespServiceEntries([]*consul.AgentService{
+		{Address: "10.0.0.1", Port: 1},
+		{Address: "10.0.0.2", Port: 1},
+	})
+	clk.Advance(time.Minute)
+
+	rec = waitForLogRecord(t, records, "addresses changed")
+	if rec[slog.LevelKey] != slog.LevelInfo.String() {
+		t.Errorf("addresses changed record has level %q, expected %q", rec[slog.LevelKey], slog.LevelInfo)
+	}
+	if added, _ := rec["added"].([]any); len(added) != 2 {
+		t.Errorf("added attribute is %v, expected 2 addresses", rec["added"])
+	}
+	if rec["addr_count"] != float64(2) {
+		t.Errorf("addr_count attribute is %v, expected 2", rec["addr_count"])
+	}
+}
+
+func TestGrpclogHandlerFormatsAttributes(t *testing.T) {
+	h := (&grpclogHandler{}).
+		WithAttrs([]slog.Attr{slog.String("target", "consul://user-service")}).
+		WithGroup("svc").
+		WithAttrs([]slog.Attr{slog.Int("addr_count", 2)}).(*grpclogHandler)
+
+	var sb strings.Builder
+	appendAttr(&sb, h.group, slog.String("error", "connection refused"))
+	appendAttr(&sb, h.group, slog.Any("added", []string{"10.0.0.1:1"}))
+
+	got := h.attrs + sb.String()
+	want := ` target=consul://user-service svc.addr_count=2 svc.error="connection refused" svc.added=[10.0.0.1:1]`
+	if got != want {
+		t.Errorf("formatted attributes are %q, expected %q", got, want)
+	}
+}
@@ -0,0 +1,98 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// Labels identify the service a metric is recorded for.
+type Labels struct {
+	// Service is the name of the resolved service. For metrics that are
+	// recorded for a resolver target, it contains the comma-separated
+	// names of all services of the target.
+	Service string
+	// Datacenter is the datacenter that is queried. It is empty if the
+	// datacenter of the Consul agent is queried.
+	Datacenter string
+}
+
+// ErrorType classifies errors of Consul queries.
+type ErrorType string
+
+const (
+	// ErrorTypeNone is passed for successful queries.
+	ErrorTypeNone ErrorType = ""
+	// ErrorTypeTimeout is a query that timed out.
+	ErrorTypeTimeout ErrorType = "timeout"
+	// ErrorTypeConnection is a query that failed because the connection
+	// to Consul could not be established or broke.
+	ErrorTypeConnection ErrorType = "connection"
+	// ErrorTypeStatus is a query that Consul answered with an unsuccessful
+	// HTTP status code.
+	ErrorTypeStatus ErrorType = "status"
+	// ErrorTypeOther is any other error.
+	ErrorTypeOther ErrorType = "other"
+)
+
+// Metrics records the activity of resolvers.
+// An OpenTelemetry implementation is provided by the otelmetrics package.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// QueryDone is called when a query for the instances of a service
+	// finished. errType is [ErrorTypeNone] if the query succeeded.
+	QueryDone(l Labels, latency time.Duration, errType ErrorType)
+	// RetryCount is called with the number of consecutive failed queries
+	// of a service when it changes. It is 0 after a successful query.
+	RetryCount(l Labels, retries int)
+	// StateReported is called when a state with addresses addresses is
+	// reported to gRPC for a resolver target.
+	StateReported(l Labels, addresses int)
+	// ErrorReported is called when an error is reported to gRPC for a
+	// resolver target.
+	ErrorReported(l Labels)
+	// WaitIndexReset is called when Consul responded with a smaller
+	// index than in the previous query of a service and the blocking
+	// query loop is restarted.
+	WaitIndexReset(l Labels)
+	// TooFastResponse is called when Consul responded too fast with
+	// unchanged data to a query for a service and the next query is
+	// delayed.
+	TooFastResponse(l Labels)
+}
+
+// noopMetrics is a [Metrics] implementation that does nothing.
+type noopMetrics struct{}
+
+func (noopMetrics) QueryDone(Labels, time.Duration, ErrorType) {}
+func (noopMetrics) RetryCount(Labels, int)                     {}
+func (noopMetrics) StateReported(Labels, int)                  {}
+func (noopMetrics) ErrorReported(Labels)                       {}
+func (noopMetrics) WaitIndexReset(Labels)                      {}
+func (noopMetrics) TooFastResponse(Labels)                     {}
+
+// errorTypeOf classifies err.
+func errorTypeOf(err error) ErrorType {
+	if err == nil {
+		return ErrorTypeNone
+	}
+
+	var statusErr consul.StatusError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorTypeTimeout
+	case errors.As(err, &statusErr):
+		return ErrorTypeStatus
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTypeTimeout
+	case errors.As(err, &netErr):
+		return ErrorTypeConnection
+	default:
+		return ErrorTypeOther
+	}
+}
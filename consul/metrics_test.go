@@ -0,0 +1,175 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+// recordingMetrics is a Metrics implementation that counts the calls of its
+// methods.
+type recordingMetrics struct {
+	mutex           sync.Mutex
+	queries         map[ErrorType]int
+	retryCount      int
+	stateReported   int
+	addresses       int
+	errorReported   int
+	tooFastResponse int
+	labels          []Labels
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{queries: map[ErrorType]int{}}
+}
+
+func (m *recordingMetrics) record(l Labels, f func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.labels = append(m.labels, l)
+	f()
+}
+
+func (m *recordingMetrics) QueryDone(l Labels, _ time.Duration, errType ErrorType) {
+	m.record(l, func() { m.queries[errType]++ })
+}
+
+func (m *recordingMetrics) RetryCount(l Labels, retries int) {
+	m.record(l, func() { m.retryCount = retries })
+}
+
+func (m *recordingMetrics) StateReported(l Labels, addresses int) {
+	m.record(l, func() {
+		m.stateReported++
+		m.addresses = addresses
+	})
+}
+
+func (m *recordingMetrics) ErrorReported(l Labels) {
+	m.record(l, func() { m.errorReported++ })
+}
+
+func (m *recordingMetrics) WaitIndexReset(l Labels) {
+	m.record(l, func() {})
+}
+
+func (m *recordingMetrics) TooFastResponse(l Labels) {
+	m.record(l, func() { m.tooFastResponse++ })
+}
+
+func (m *recordingMetrics) get(f func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	f()
+}
+
+func TestErrorTypeOf(t *testing.T) {
+	tcs := []struct {
+		err  error
+		want ErrorType
+	}{
+		{err: nil, want: ErrorTypeNone},
+		{err: fmt.Errorf("query failed: %w", context.DeadlineExceeded), want: ErrorTypeTimeout},
+		{err: consul.StatusError{Code: 403, Body: "ACL not found"}, want: ErrorTypeStatus},
+		{
+			err:  &url.Error{Op: "Get", URL: "http://127.0.0.1:8500", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}},
+			want: ErrorTypeConnection,
+		},
+		{err: errors.New("unexpected"), want: ErrorTypeOther},
+	}
+
+	for _, tc := range tcs {
+		if got := errorTypeOf(tc.err); got != tc.want {
+			t.Errorf("errorTypeOf(%v) is %q, expected %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestMetricsAreRecorded(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	health.SetRespError(consul.StatusError{Code: 500, Body: "rpc error"})
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	cc := mocks.NewClientConn()
+	clk := mocks.NewClock()
+	metrics := newRecordingMetrics()
+	target := resolver.Target{URL: url.URL{Path: "user-service", RawQuery: "dc=dc2"}}
+
+	r, err := NewBuilder(WithMetrics(metrics), withClock(clk)).Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	clk.WaitForTimers(1)
+
+	metrics.get(func() {
+		if metrics.queries[ErrorTypeStatus] != 1 {
+			t.Errorf("recorded %d failed queries, expected 1", metrics.queries[ErrorTypeStatus])
+		}
+
+		if metrics.retryCount != 1 {
+			t.Errorf("retry count is %d, expected 1", metrics.retryCount)
+		}
+
+		if metrics.errorReported != 1 {
+			t.Errorf("recorded %d reported errors, expected 1", metrics.errorReported)
+		}
+	})
+
+	health.SetRespError(nil)
+	health.SetRespServiceEntries([]*consul.AgentService{
+		{Address: "10.0.0.1", Port: 1},
+		{Address: "10.0.0.2", Port: 1},
+	})
+
+	clk.Advance(time.Minute)
+	waitForAddrs(t, cc, []resolver.Address{{Addr: "10.0.0.1:1"}, {Addr: "10.0.0.2:1"}})
+
+	// the mock responds to the next query immediately with the same
+	// data, it is delayed by the too-fast-response protection
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	clk.WaitForTimers(1)
+
+	metrics.get(func() {
+		if metrics.queries[ErrorTypeNone] != 2 {
+			t.Errorf("recorded %d successful queries, expected 2", metrics.queries[ErrorTypeNone])
+		}
+
+		if metrics.retryCount != 0 {
+			t.Errorf("retry count is %d after a successful query, expected 0", metrics.retryCount)
+		}
+
+		if metrics.stateReported != 1 || metrics.addresses != 2 {
+			t.Errorf("recorded %d reported states with %d addresses, expected 1 state with 2 addresses",
+				metrics.stateReported, metrics.addresses)
+		}
+
+		if metrics.tooFastResponse != 1 {
+			t.Errorf("recorded %d too fast responses, expected 1", metrics.tooFastResponse)
+		}
+
+		want := Labels{Service: "user-service", Datacenter: "dc2"}
+		for _, l := range metrics.labels {
+			if l != want {
+				t.Errorf("metric was recorded with labels %+v, expected %+v", l, want)
+			}
+		}
+	})
+}
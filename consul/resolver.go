@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"slices"
 	"strings"
@@ -11,36 +12,190 @@ import (
 	"time"
 
 	consul "github.com/hashicorp/consul/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/grpclog"
 	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/clock"
 )
 
 type healthFilter int
 
 type consulResolver struct {
-	cc             resolver.ClientConn
-	consulHealth   consulHealthEndpoint
-	service        string
-	tags           []string
-	healthFilter   healthFilter
+	cc                  resolver.ClientConn
+	consulHealth        consulHealthEndpoint
+	consulAgent         consulAgentEndpoint
+	consulKV            consulKVEndpoint
+	consulConfigEntries consulConfigEntriesEndpoint
+	consulCatalog       consulCatalogEndpoint
+	services            []*serviceWatcher
+	opts                *resolverOpts
+	ctx                 context.Context
+	cancel              context.CancelFunc
+	wgStop              sync.WaitGroup
+
+	// mutex protects lastReporterState and the query results stored in
+	// the serviceWatchers.
+	mutex             sync.Mutex
+	lastReporterState state
+
+	// serviceConfig is the last valid parsed service config,
+	// serviceConfigJSON the last retrieved raw service config.
+	// serviceConfigLoaded is true when the first query for the service
+	// config finished. Until then no addresses are reported, to prevent
+	// that the ClientConn uses the default service config.
+	// The fields are protected by mutex.
+	serviceConfig       *serviceconfig.ParseResult
+	serviceConfigJSON   string
+	serviceConfigLoaded bool
+
+	// clientLocality is the locality of the client that is reported
+	// when the locality of the instances is resolved.
+	// It is protected by mutex.
+	clientLocality Locality
+
+	// cache stores the reported endpoints on disk, it is nil if the
+	// cache is disabled. cachedEndpoints are the endpoints loaded from
+	// the cache, they are reported until the first query succeeds and
+	// then set to nil.
+	// The fields are protected by mutex.
+	cache           *endpointCache
+	cachedEndpoints []resolver.Endpoint
+
+	clock clock.Clock
+
+	// metrics records the activity of the resolver, targetLabels are
+	// the labels of the metrics that are recorded for the target.
+	metrics      Metrics
+	targetLabels Labels
+
+	// tracer records spans for the queries of the services.
+	tracer trace.Tracer
+
+	// target is opts.target with the token redacted, it is passed to
+	// the event handler, logs and the status page.
+	target string
+
+	// log is the logger of the resolver, it has the target as
+	// attribute.
+	log *slog.Logger
+
+	// events passes events to the handler registered via
+	// WithEventHandler, it is nil if none is registered.
+	// reportedAddrs are the addresses that were reported to
+	// [c.cc.UpdateState] last, they are protected by mutex.
+	events        *eventDispatcher
+	reportedAddrs []string
+	// addressChanges are the last changes of reportedAddrs, they are
+	// protected by mutex.
+	addressChanges []AddressChange
+
+	// onClose is called when the resolver is closed, it can be nil.
+	onClose func()
+	// stateReported is true when [c.cc.UpdateState] has been called.
+	// debounceTimer reports the pending state update when the updates
+	// are debounced, it is nil if no update is pending.
+	// debouncePendingSince is the time of the first pending update,
+	// debounceDeadline the time when the timer expires.
+	// The fields are protected by mutex.
+	stateReported        bool
+	debounceTimer        clock.Timer
+	debouncePendingSince time.Time
+	debounceDeadline     time.Time
+
+	// initialResolveTimer reports [ErrInitialResolveTimeout] when no
+	// addresses are retrieved from Consul within the
+	// initialResolveTimeout, it is nil if none is configured or it
+	// stopped. initialResolveExpired is true after the timeout expired
+	// until addresses are retrieved, empty states and query errors are
+	// then reported as [consulResolver.initialResolveError].
+	// The fields are protected by mutex.
+	initialResolveTimer   clock.Timer
+	initialResolveExpired bool
+
+	// agentSelfMutex protects agentSelf, the cached response of the
+	// agent self endpoint.
+	agentSelfMutex sync.Mutex
+	agentSelf      map[string]map[string]interface{}
+}
+
+// serviceWatcher holds the state of the blocking query loop for one of the
+// services of the resolver.
+type serviceWatcher struct {
+	name           string
+	labels         Labels
+	log            *slog.Logger
 	backoffCounter *backoff
-	ctx            context.Context
-	cancel         context.CancelFunc
 	resolveNow     chan struct{}
-	wgStop         sync.WaitGroup
 
-	lastReporterState state
+	// resolved is true when the last query for the service succeeded,
+	// endpoints then contains its result. If the last query failed err
+	// is set.
+	resolved  bool
+	endpoints []resolver.Endpoint
+	err       error
+
+	// subsetMutex protects the subset fields.
+	// subset is the definition of the service-resolver subset that is
+	// resolved, it is nil until it has been retrieved. subsetErr is set if
+	// the subset can not be resolved. cancelQuery cancels the running
+	// health query.
+	// subsetGeneration is incremented when the subset changes,
+	// queriedSubsetGeneration is the generation of the last health query.
+	// When they differ, the wait index of the previous subset must not be
+	// used.
+	subsetMutex             sync.Mutex
+	subset                  *subsetFilter
+	subsetErr               error
+	cancelQuery             context.CancelFunc
+	subsetGeneration        uint64
+	queriedSubsetGeneration uint64
+
+	// failingSince is the time when the first of the consecutive failed
+	// queries happened while the error policy keeps the last state.
+	// gracePeriodTimer discards the endpoints when the grace period
+	// expires. The fields are protected by consulResolver.mutex.
+	failingSince     time.Time
+	gracePeriodTimer clock.Timer
+
+	// waitIndex is the index of the last successful query, retryCount
+	// the number of consecutive failed queries and lastSuccess the time
+	// of the last successful query. The fields are protected by
+	// consulResolver.mutex.
+	waitIndex   uint64
+	retryCount  int
+	lastSuccess time.Time
+
+	// registration is the cached result of the catalog query that
+	// checks why the service has no instances, it is nil if the service
+	// has instances or the check failed. It is protected by
+	// consulResolver.mutex.
+	registration *registrationCheck
+
+	// shrink is the held back result of the service, when it removed
+	// more instances than allowed by maxShrink. It is protected by
+	// consulResolver.mutex.
+	shrink *heldShrink
 }
 
 type state struct {
-	addresses []resolver.Address
-	err       error
+	endpoints      []resolver.Endpoint
+	serviceConfig  *serviceconfig.ParseResult
+	clientLocality Locality
+	err            error
 }
 
 type consulHealthEndpoint interface {
 	ServiceMultipleTags(service string, tags []string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error)
 }
 
+type consulAgentEndpoint interface {
+	Self() (map[string]map[string]interface{}, error)
+}
+
 const (
 	healthFilterUndefined healthFilter = iota
 	healthFilterOnlyHealthy
@@ -60,92 +215,377 @@ var consulCreateHealthClientFn = func(cfg *consul.Config) (consulHealthEndpoint,
 	return clt.Health(), nil
 }
 
+// consulCreateAgentClientFn can be overwritten in tests to make
+// newConsulResolver() return a different consulAgentEndpoint implementation
+var consulCreateAgentClientFn = func(cfg *consul.Config) (consulAgentEndpoint, error) {
+	clt, err := consul.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return clt.Agent(), nil
+}
+
 func newConsulResolver(
 	cc resolver.ClientConn,
-	scheme, consulAddr, consulService string,
-	tags []string,
-	healthFilter healthFilter,
-	token string,
+	consulAddr string,
+	opts *resolverOpts,
 ) (*consulResolver, error) {
 	cfg := consul.Config{
 		Address:  consulAddr,
-		Scheme:   scheme,
-		Token:    token,
+		Scheme:   opts.scheme,
+		Token:    opts.token,
 		WaitTime: 10 * time.Minute,
 	}
 
-	health, err := consulCreateHealthClientFn(&cfg)
-	if err != nil {
-		return nil, fmt.Errorf("creating consul client failed: %w", err)
+	target := redactToken(opts.target)
+
+	log := newLogger(opts.logger).With("target", target)
+	if opts.datacenter != "" {
+		log = log.With("dc", opts.datacenter)
+	}
+
+	clk := opts.clock
+	if clk == nil {
+		clk = clock.Real{}
+	}
+
+	var health consulHealthEndpoint
+	var err error
+
+	if opts.tracerProvider != nil && opts.transport == transportHTTP {
+		cfg.HttpClient, err = newTracingHTTPClient()
+		if err != nil {
+			return nil, fmt.Errorf("creating consul http client failed: %w", err)
+		}
+	}
+
+	var catalog consulCatalogEndpoint
+	if opts.transport == transportDNS {
+		health = newDNSHealthEndpoint(consulAddr, opts.datacenter, clk, log)
+	} else {
+		health, err = consulCreateHealthClientFn(&cfg)
+		if err != nil {
+			return nil, fmt.Errorf("creating consul client failed: %w", err)
+		}
+
+		catalog, err = consulCreateCatalogClientFn(&cfg)
+		if err != nil {
+			return nil, fmt.Errorf("creating consul catalog client failed: %w", err)
+		}
+	}
+
+	var agent consulAgentEndpoint
+	if (opts.translateWAN && opts.datacenter != "") ||
+		(opts.localityEnabled() && opts.clientLocality.IsZero()) {
+		agent, err = consulCreateAgentClientFn(&cfg)
+		if err != nil {
+			return nil, fmt.Errorf("creating consul agent client failed: %w", err)
+		}
+	}
+
+	var kv consulKVEndpoint
+	if opts.serviceConfigKey != "" {
+		kv, err = consulCreateKVClientFn(&cfg)
+		if err != nil {
+			return nil, fmt.Errorf("creating consul kv client failed: %w", err)
+		}
+	}
+
+	var configEntries consulConfigEntriesEndpoint
+	if opts.serviceConfigFromConfigEntries || opts.useSubset {
+		configEntries, err = consulCreateConfigEntriesClientFn(&cfg)
+		if err != nil {
+			return nil, fmt.Errorf("creating consul config entries client failed: %w", err)
+		}
+	}
+
+	metrics := opts.metrics
+	if metrics == nil {
+		metrics = noopMetrics{}
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
+	services := make([]*serviceWatcher, 0, len(opts.services))
+	for _, name := range opts.services {
+		services = append(services, &serviceWatcher{
+			name:           name,
+			labels:         Labels{Service: name, Datacenter: opts.datacenter},
+			log:            log.With("service", name),
+			backoffCounter: defaultBackoff(clk),
+			resolveNow:     make(chan struct{}, 1),
+		})
+	}
+
+	var events *eventDispatcher
+	if opts.eventHandler != nil {
+		events = newEventDispatcher(opts.eventHandler, log)
+	}
+
+	var cache *endpointCache
+	if opts.cacheDir != "" {
+		cache = newEndpointCache(opts.cacheDir, opts.target, opts.cacheMaxAge, clk, log)
+	}
+
 	return &consulResolver{
-		cc:             cc,
-		consulHealth:   health,
-		service:        consulService,
-		tags:           tags,
-		healthFilter:   healthFilter,
-		backoffCounter: defaultBackoff(),
-		ctx:            ctx,
-		cancel:         cancel,
-		resolveNow:     make(chan struct{}, 1),
+		cache:               cache,
+		cc:                  cc,
+		clock:               clk,
+		target:              target,
+		log:                 log,
+		metrics:             metrics,
+		tracer:              tracer(opts.tracerProvider),
+		events:              events,
+		targetLabels:        Labels{Service: strings.Join(opts.services, ","), Datacenter: opts.datacenter},
+		consulHealth:        health,
+		consulAgent:         agent,
+		consulKV:            kv,
+		consulConfigEntries: configEntries,
+		consulCatalog:       catalog,
+		services:            services,
+		opts:                opts,
+		ctx:                 ctx,
+		cancel:              cancel,
 	}, nil
 }
 
 func (c *consulResolver) start() {
-	c.wgStop.Add(1)
-	go c.watcher()
-}
+	c.startInitialResolveTimer()
 
-func (c *consulResolver) query(opts *consul.QueryOptions) ([]resolver.Address, uint64, error) {
-	if logger.V(2) {
-		var tagsDescr, healthyDescr string
-		if len(c.tags) > 0 {
-			tagsDescr = "with tags: " + strings.Join(c.tags, ", ")
-		}
-		if c.healthFilter == healthFilterOnlyHealthy {
-			healthyDescr = "healthy "
+	if c.events != nil {
+		c.wgStop.Add(1)
+		go func() {
+			defer c.wgStop.Done()
+			c.events.run(c.ctx)
+		}()
+	}
+
+	if c.cache != nil {
+		c.loadCache()
+	}
+
+	switch {
+	case c.consulKV != nil:
+		c.wgStop.Add(1)
+		go c.serviceConfigKVWatcher()
+
+	case c.opts.serviceConfigFromConfigEntries:
+		c.serviceConfigConfigEntriesWatcher()
+
+	default:
+		c.serviceConfigLoaded = true
+	}
+
+	for _, svc := range c.services {
+		if c.opts.useSubset {
+			c.wgStop.Add(1)
+			go c.subsetWatcher(svc)
 		}
 
-		logger.Infof("querying consul for "+healthyDescr+"addresses of service '%s'"+tagsDescr, c.service)
+		c.wgStop.Add(1)
+		go c.watcher(svc)
 	}
+}
 
-	entries, meta, err := c.consulHealth.ServiceMultipleTags(c.service, c.tags, c.healthFilter == healthFilterOnlyHealthy, opts)
+// query returns one endpoint for each instance of the service that matches
+// the filters of the resolver. The endpoint contains all addresses of the
+// instance, see entryAddresses().
+func (c *consulResolver) query(service string, passingOnly bool, opts *consul.QueryOptions) ([]resolver.Endpoint, uint64, error) {
+	log := c.log.With("service", service)
+
+	log.Debug("querying consul for addresses of service",
+		"tags", c.opts.tags,
+		"passing_only", passingOnly,
+		"filter", opts.Filter,
+		"wait_index", opts.WaitIndex,
+	)
+
+	queryStart := c.clock.Now()
+	entries, meta, err := c.consulHealth.ServiceMultipleTags(service, c.opts.tags, passingOnly, opts)
+	if !errors.Is(err, context.Canceled) {
+		c.metrics.QueryDone(
+			Labels{Service: service, Datacenter: c.opts.datacenter},
+			c.clock.Since(queryStart),
+			errorTypeOf(err),
+		)
+	}
 	if err != nil {
 		return nil, 0, err
 	}
 
-	if c.healthFilter == healthFilterFallbackToUnhealthy {
+	if len(c.opts.anyTags) > 0 || len(c.opts.excludeTags) > 0 {
+		entries = filterTags(entries, c.opts.anyTags, c.opts.excludeTags)
+	}
+
+	if c.opts.health == healthFilterFallbackToUnhealthy {
 		entries = filterPreferOnlyHealthy(entries)
 	}
 
-	result := make([]resolver.Address, 0, len(entries))
+	if c.opts.localityEnabled() {
+		l, err := c.getClientLocality()
+		if err != nil {
+			log.Warn("retrieving locality of the client failed, no client locality is reported", errAttr(err))
+		} else {
+			c.mutex.Lock()
+			c.clientLocality = l
+			c.mutex.Unlock()
+		}
+	}
+
+	var localDC string
+	if c.consulAgent != nil && c.opts.translateWAN && c.opts.datacenter != "" {
+		localDC, err = c.getAgentDatacenter()
+		if err != nil {
+			log.Warn("retrieving datacenter of consul agent failed, addresses are not translated to WAN addresses", errAttr(err))
+		}
+	}
+
+	result := make([]resolver.Endpoint, 0, len(entries))
 	for _, e := range entries {
-		// when additional fields are set in addr, addressesEqual()
-		// must be updated to honor them
-		addr := e.Service.Address
-		if addr == "" {
-			addr = e.Node.Address
-
-			if logger.V(2) {
-				logger.Infof("service '%s' has no ServiceAddress, using agent address '%+v'", e.Service.ID, addr)
+		addrType := c.opts.address
+		if localDC != "" && e.Node != nil && e.Node.Datacenter != "" && e.Node.Datacenter != localDC {
+			addrType = addrType.wan()
+		}
+
+		var port int
+
+		switch {
+		case c.opts.port != 0:
+			port = c.opts.port
+
+		case c.opts.portMeta != "":
+			var err error
+
+			port, err = metaPort(e, c.opts.portMeta)
+			if err != nil {
+				log.Warn("ignoring instance", "instance", e.Service.ID, errAttr(err))
+				continue
 			}
 		}
 
-		result = append(result, resolver.Address{
-			Addr: net.JoinHostPort(addr, fmt.Sprint(e.Service.Port)),
-		})
-	}
+		// when additional fields are set in the addresses or
+		// endpoint, endpointsEqual() must be updated to honor them
+		var addrs []resolver.Address
+		for _, hp := range entryAddresses(log, e, addrType) {
+			if port != 0 {
+				hp.port = port
+			}
+
+			addr := resolver.Address{Addr: net.JoinHostPort(hp.host, fmt.Sprint(hp.port))}
+			if !slices.Contains(addrs, addr) {
+				addrs = append(addrs, addr)
+			}
+		}
 
-	if logger.V(1) {
-		logger.Infof("service '%s' resolved to '%+v'", c.service, result)
+		if len(addrs) == 0 {
+			log.Warn("ignoring instance, it has no address", "instance", e.Service.ID)
+			continue
+		}
+
+		endpoint := resolver.Endpoint{Addresses: addrs}
+
+		if c.opts.localityEnabled() {
+			l := entryLocality(e, c.opts.regionMeta, c.opts.zoneMeta)
+
+			endpoint.Attributes = withLocality(endpoint.Attributes, l)
+			for i := range endpoint.Addresses {
+				endpoint.Addresses[i].BalancerAttributes = withLocality(endpoint.Addresses[i].BalancerAttributes, l)
+			}
+		}
+
+		result = append(result, endpoint)
 	}
 
+	log.Debug("service resolved",
+		"wait_index", meta.LastIndex,
+		"addr_count", len(result),
+		"endpoints", result,
+	)
+
 	return slices.Clip(result), meta.LastIndex, nil
 }
 
+// getAgentSelf returns the response of the agent self endpoint.
+// It is retrieved once and then cached.
+func (c *consulResolver) getAgentSelf() (map[string]map[string]interface{}, error) {
+	c.agentSelfMutex.Lock()
+	defer c.agentSelfMutex.Unlock()
+
+	if c.agentSelf != nil {
+		return c.agentSelf, nil
+	}
+
+	self, err := c.consulAgent.Self()
+	if err != nil {
+		return nil, err
+	}
+
+	c.agentSelf = self
+
+	return self, nil
+}
+
+// getAgentDatacenter returns the datacenter of the Consul agent.
+func (c *consulResolver) getAgentDatacenter() (string, error) {
+	self, err := c.getAgentSelf()
+	if err != nil {
+		return "", err
+	}
+
+	dc, ok := self["Config"]["Datacenter"].(string)
+	if !ok || dc == "" {
+		return "", errors.New("agent self response contains no datacenter")
+	}
+
+	return dc, nil
+}
+
+// getClientLocality returns the locality of the client.
+// If it was not passed to the builder, it is read from the node metadata of
+// the Consul agent.
+func (c *consulResolver) getClientLocality() (Locality, error) {
+	if !c.opts.clientLocality.IsZero() {
+		return c.opts.clientLocality, nil
+	}
+
+	self, err := c.getAgentSelf()
+	if err != nil {
+		return Locality{}, err
+	}
+
+	return agentLocality(self, c.opts.regionMeta, c.opts.zoneMeta)
+}
+
+// filterTags returns the entries that have at least one of the tags in anyTags
+// and none of the tags in excludeTags.
+// If anyTags is empty, entries are not required to have any tag.
+func filterTags(entries []*consul.ServiceEntry, anyTags, excludeTags []string) []*consul.ServiceEntry {
+	result := make([]*consul.ServiceEntry, 0, len(entries))
+
+	for _, e := range entries {
+		if matchesTagFilters(e.Service.Tags, anyTags, excludeTags) {
+			result = append(result, e)
+		}
+	}
+
+	return result
+}
+
+// matchesTagFilters returns true if tags contain one of anyTags, if it is
+// not empty, and none of excludeTags.
+func matchesTagFilters(tags, anyTags, excludeTags []string) bool {
+	if len(anyTags) > 0 && !slices.ContainsFunc(anyTags, func(t string) bool {
+		return slices.Contains(tags, t)
+	}) {
+		return false
+	}
+
+	return !slices.ContainsFunc(excludeTags, func(t string) bool {
+		return slices.Contains(tags, t)
+	})
+}
+
 // filterPreferOnlyHealthy if entries contains services with passing health
 // check only entries with passing health are returned.
 // Otherwise entries is returned unchanged.
@@ -165,66 +605,159 @@ func filterPreferOnlyHealthy(entries []*consul.ServiceEntry) []*consul.ServiceEn
 	return entries
 }
 
-func addressesEqual(a, b []resolver.Address) bool {
+// compareEndpoints compares the addresses and localities of the endpoints.
+func compareEndpoints(e, e1 resolver.Endpoint) int {
+	if r := slices.CompareFunc(e.Addresses, e1.Addresses, func(a, a1 resolver.Address) int {
+		return strings.Compare(a.Addr, a1.Addr)
+	}); r != 0 {
+		return r
+	}
+
+	l, _ := e.Attributes.Value(localityKey{}).(Locality)
+	l1, _ := e1.Attributes.Value(localityKey{}).(Locality)
+
+	if r := strings.Compare(l.Region, l1.Region); r != 0 {
+		return r
+	}
+
+	return strings.Compare(l.Zone, l1.Zone)
+}
+
+func endpointsEqual(a, b []resolver.Endpoint) bool {
 	if (a == nil && b != nil) || (a != nil && b == nil) {
 		return false
 	}
 
-	return slices.CompareFunc(a, b, func(e, e1 resolver.Address) int {
-		return strings.Compare(e.Addr, e1.Addr)
-	}) == 0
+	return slices.CompareFunc(a, b, compareEndpoints) == 0
 }
 
-func (c *consulResolver) watcher() {
-	var retryTimer *time.Timer
+func (c *consulResolver) watcher(svc *serviceWatcher) {
+	var retryTimer clock.Timer
 	var retryCnt int
 
-	opts := (&consul.QueryOptions{}).WithContext(c.ctx)
+	opts := (&consul.QueryOptions{Datacenter: c.opts.datacenter}).WithContext(c.ctx)
 
 	defer c.wgStop.Done()
 
 	for {
 		for {
-			var addrs []resolver.Address
+			var endpoints []resolver.Endpoint
 			var err error
 
 			lastWaitIndex := opts.WaitIndex
-			queryStartTime := time.Now()
+			queryStartTime := c.clock.Now()
 
 			if retryTimer != nil {
 				retryTimer.Stop()
 			}
 
+			passingOnly := c.opts.health == healthFilterOnlyHealthy
+			queryOpts := opts
+
+			if c.opts.useSubset {
+				subsetOpts, subset, ok := c.subsetQueryOpts(svc, opts)
+				if !ok {
+					break
+				}
+
+				passingOnly = passingOnly || subset.onlyPassing
+				queryOpts = subsetOpts
+				// the wait index is reset when the subset
+				// changed since the last query
+				lastWaitIndex = queryOpts.WaitIndex
+			}
+
 			// query() blocks until a consul internal timeout expired or
 			// data newer then the passed opts.WaitIndex is available.
-			addrs, opts.WaitIndex, err = c.query(opts)
+			ctx, span := c.startQuerySpan(queryOpts.Context(), svc.name, passingOnly, queryOpts.WaitIndex)
+			endpoints, opts.WaitIndex, err = c.query(svc.name, passingOnly, queryOpts.WithContext(ctx))
+			recordQueryResult(span, len(endpoints), opts.WaitIndex, err)
 			if err != nil {
+				span.End()
+
 				if errors.Is(err, context.Canceled) {
+					if c.ctx.Err() == nil {
+						// the query was canceled because the
+						// subset definition changed
+						continue
+					}
+
 					return
 				}
 
-				retryIn := c.backoffCounter.Backoff(retryCnt)
-				logger.Infof("resolving service name '%s' via consul failed, retrying in %s: %s",
-					c.service, retryIn, err)
+				retryIn := svc.backoffCounter.Backoff(retryCnt)
+				svc.log.Info("resolving service via consul failed, retrying",
+					"retry_in", retryIn,
+					"retry_count", retryCnt+1,
+					errAttr(err),
+				)
 
-				retryTimer = time.AfterFunc(c.backoffCounter.Backoff(retryCnt), func() {
-					c.ResolveNow(resolver.ResolveNowOptions{})
-				})
+				retryTimer = c.clock.AfterFunc(retryIn, svc.triggerResolve)
 				retryCnt++
+				c.metrics.RetryCount(svc.labels, retryCnt)
+				c.recordQueryStatus(svc, retryCnt, 0, err)
+				c.events.emit(ResolutionFailed{
+					Target:  c.target,
+					Service: svc.name,
+					Err:     err,
+					RetryIn: retryIn,
+				})
 
-				c.reportError(err)
+				c.reportError(svc, err)
 				break
 			}
-			retryCnt = 0
+			if retryCnt != 0 {
+				retryCnt = 0
+				c.metrics.RetryCount(svc.labels, 0)
+				c.events.emit(Recovered{Target: c.target, Service: svc.name})
+			}
+			c.recordQueryStatus(svc, 0, opts.WaitIndex, nil)
 
 			if opts.WaitIndex < lastWaitIndex {
-				logger.Infof("consul responded with a smaller waitIndex (%d) then the previous one (%d), restarting blocking query loop",
-					opts.WaitIndex, lastWaitIndex)
+				svc.log.Info("consul responded with a smaller waitIndex than the previous one, restarting blocking query loop",
+					"wait_index", opts.WaitIndex,
+					"previous_wait_index", lastWaitIndex,
+				)
+				c.metrics.WaitIndexReset(svc.labels)
+				c.events.emit(WaitIndexReset{
+					Target:        c.target,
+					Service:       svc.name,
+					Index:         opts.WaitIndex,
+					PreviousIndex: lastWaitIndex,
+				})
 				opts.WaitIndex = 0
+				span.End()
 				continue
 			}
 
-			if !c.reportAddress(addrs) {
+			if len(endpoints) == 0 {
+				c.checkRegistration(svc, passingOnly, opts.WaitIndex)
+			}
+
+			updated, sent := c.reportEndpoints(svc, endpoints)
+			if sent {
+				span.AddEvent("addresses reported", trace.WithAttributes(
+					attribute.Int("consul.endpoint_count", len(endpoints)),
+				))
+			}
+			span.End()
+
+			if !updated {
+				if c.awaitingShrinkConfirmation(svc) {
+					// Query again without blocking, to
+					// confirm that the service has no
+					// instances.
+					opts.WaitIndex = 0
+
+					select {
+					case <-c.ctx.Done():
+						return
+					case <-c.clock.After(shrinkConfirmInterval):
+					}
+
+					continue
+				}
+
 				// If the consul server responds with
 				// the same data than in the last
 				// query in less than 50ms, sleep a
@@ -232,10 +765,17 @@ func (c *consulResolver) watcher() {
 				// This should only happen if the consul server
 				// is buggy but better be safe. :-)
 				if lastWaitIndex == opts.WaitIndex &&
-					time.Since(queryStartTime) < 50*time.Millisecond {
-					logger.Warningf("consul responded too fast with same data and waitIndex (%d) than in previous query, delaying next query",
-						opts.WaitIndex)
-					time.Sleep(50 * time.Millisecond)
+					c.clock.Since(queryStartTime) < 50*time.Millisecond {
+					svc.log.Warn("consul responded too fast with same data and waitIndex than in previous query, delaying next query",
+						"wait_index", opts.WaitIndex,
+					)
+					c.metrics.TooFastResponse(svc.labels)
+
+					select {
+					case <-c.ctx.Done():
+						return
+					case <-c.clock.After(50 * time.Millisecond):
+					}
 				}
 
 				continue
@@ -250,39 +790,305 @@ func (c *consulResolver) watcher() {
 
 			return
 
-		case <-c.resolveNow:
+		case <-svc.resolveNow:
+		}
+	}
+}
+
+// blockingQueryLoop runs query in a loop until c.ctx is canceled.
+// query must run a blocking Consul query with the passed options and return
+// the index of the result and if the result differs from the previous one.
+// descr describes the queried data, it is used in log messages.
+// If query fails, queryFailed is called and query is retried after a backoff
+// delay.
+func (c *consulResolver) blockingQueryLoop(
+	descr string,
+	query func(*consul.QueryOptions) (uint64, bool, error),
+	queryFailed func(error),
+) {
+	var retryCnt int
+
+	backoffCounter := defaultBackoff(c.clock)
+	opts := (&consul.QueryOptions{Datacenter: c.opts.datacenter}).WithContext(c.ctx)
+
+	for {
+		lastWaitIndex := opts.WaitIndex
+		queryStartTime := c.clock.Now()
+
+		c.log.Debug("querying " + descr)
+
+		waitIndex, changed, err := query(opts)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+
+			retryIn := backoffCounter.Backoff(retryCnt)
+			c.log.Info("querying "+descr+" failed, retrying", "retry_in", retryIn, errAttr(err))
+			retryCnt++
+
+			queryFailed(err)
+
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-c.clock.After(retryIn):
+			}
+
+			continue
+		}
+		retryCnt = 0
+
+		opts.WaitIndex = waitIndex
+		if opts.WaitIndex < lastWaitIndex {
+			c.log.Info("consul responded with a smaller waitIndex than the previous one, restarting blocking query loop",
+				"query", descr,
+				"wait_index", opts.WaitIndex,
+				"previous_wait_index", lastWaitIndex,
+			)
+			opts.WaitIndex = 0
+			continue
+		}
+
+		if !changed &&
+			lastWaitIndex == opts.WaitIndex &&
+			c.clock.Since(queryStartTime) < 50*time.Millisecond {
+			// see the comment in watcher()
+			c.log.Warn("consul responded too fast with same data and waitIndex than in previous query, delaying next query",
+				"query", descr,
+				"wait_index", opts.WaitIndex,
+			)
+
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-c.clock.After(50 * time.Millisecond):
+			}
 		}
 	}
 }
 
-// reportAddress reports addrs to [c.cc.UpdateState] if it differs from the
-// previous reported addresses or an error has been reported before.
-// It returns true if [c.cc.UpdateState] has been called.
-func (c *consulResolver) reportAddress(addrs []resolver.Address) bool {
-	slices.SortFunc(addrs, func(e, e1 resolver.Address) int {
-		return strings.Compare(e.Addr, e1.Addr)
+// reportEndpoints stores endpoints as result of svc and reports the union of
+// the endpoints of all services to [c.cc.UpdateState] if it differs from the
+// previous reported endpoints or an error has been reported before.
+// Results that remove more instances than allowed by maxShrink are held
+// back, see guardShrink().
+// updated is true if the reported state changed. sent is true if the
+// addresses were passed to [c.cc.UpdateState], it is false when the update is
+// debounced and reported later.
+func (c *consulResolver) reportEndpoints(svc *serviceWatcher, endpoints []resolver.Endpoint) (updated, sent bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	svc.err = nil
+	svc.stopGracePeriod()
+
+	if !c.guardShrink(svc, endpoints) {
+		return false, false
+	}
+
+	svc.resolved = true
+	svc.endpoints = endpoints
+	if len(endpoints) > 0 {
+		svc.registration = nil
+	}
+
+	updated = c.updateState()
+	c.storeCache()
+
+	sent = updated && c.debounceTimer == nil && c.lastReporterState.err == nil
+
+	return updated, sent
+}
+
+// reportError stores err as result of svc. If none of the services of the
+// resolver has been resolved successfully, the errors are reported to
+// [c.cc.ReportError], otherwise the addresses of the remaining services are
+// reported via [c.cc.UpdateState].
+// With the [ErrorPolicyKeepLastState] the last endpoints of svc are kept
+// until the grace period expired.
+// It returns true if c.cc has been called.
+func (c *consulResolver) reportError(svc *serviceWatcher, err error) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	svc.err = err
+
+	if c.opts.errorPolicy == ErrorPolicyKeepLastState && svc.resolved {
+		c.startGracePeriod(svc)
+		return false
+	}
+
+	svc.resolved = false
+	svc.endpoints = nil
+	svc.stopShrinkHold()
+
+	return c.reportErrors()
+}
+
+// reportErrors reports the errors of the services to [c.cc.ReportError] if
+// none of the services is resolved, otherwise the endpoints of the resolved
+// services are reported via [c.cc.UpdateState].
+// It returns true if c.cc has been called.
+// c.mutex must be held when calling the method.
+func (c *consulResolver) reportErrors() bool {
+	var errs []error
+	for _, s := range c.services {
+		if s.resolved {
+			return c.updateState()
+		}
+
+		if s.err == nil {
+			continue
+		}
+
+		if len(c.services) == 1 {
+			errs = append(errs, s.err)
+			continue
+		}
+
+		errs = append(errs, fmt.Errorf("resolving service '%s' failed: %w", s.name, s.err))
+	}
+
+	if c.cachedEndpoints != nil {
+		c.log.Warn("querying consul failed, keeping stale cached addresses", errAttr(errors.Join(errs...)))
+		return c.updateState()
+	}
+
+	if c.initialResolveExpired {
+		return c.updateError(c.initialResolveError())
+	}
+
+	return c.updateError(errors.Join(errs...))
+}
+
+// updateState reports the deduplicated union of the addresses of all
+// resolved services together with the service config to
+// [c.cc.UpdateState], if it differs from the previous reported state or an
+// error has been reported before.
+// If updates are debounced, the report is delayed, except for the first
+// state and the first state after an error.
+// It returns true if the state changed.
+// c.mutex must be held when calling the method.
+func (c *consulResolver) updateState() bool {
+	var endpoints []resolver.Endpoint
+	var resolved bool
+
+	for _, svc := range c.services {
+		if svc.resolved {
+			resolved = true
+			endpoints = append(endpoints, svc.endpoints...)
+		}
+	}
+
+	switch {
+	case c.cachedEndpoints != nil && (!resolved || !c.serviceConfigLoaded):
+		endpoints = c.cachedEndpoints
+
+	case !c.serviceConfigLoaded:
+		return false
+
+	case c.cachedEndpoints != nil:
+		c.log.Info("replacing cached addresses with addresses retrieved from consul")
+		c.cachedEndpoints = nil
+	}
+
+	slices.SortFunc(endpoints, compareEndpoints)
+	endpoints = slices.CompactFunc(endpoints, func(e, e1 resolver.Endpoint) bool {
+		return compareEndpoints(e, e1) == 0
 	})
+	if endpoints == nil {
+		endpoints = []resolver.Endpoint{}
+	}
 
-	if c.lastReporterState.err == nil && addressesEqual(addrs, c.lastReporterState.addresses) {
+	switch {
+	case len(endpoints) > 0 && c.cachedEndpoints == nil:
+		c.stopInitialResolveTimer()
+	case c.initialResolveExpired:
+		return c.updateError(c.initialResolveError())
+	case len(endpoints) == 0 && c.cachedEndpoints == nil:
+		// report why no instances were found instead of an empty
+		// state, the ClientConn would only fail with a generic
+		// error
+		if err := c.noInstancesError(); err != nil {
+			return c.updateError(err)
+		}
+	}
+
+	if c.opts.subsetSize != 0 {
+		endpoints = subsetEndpoints(endpoints, c.opts.clientID, c.opts.subsetSize)
+	}
+
+	if c.lastReporterState.err == nil &&
+		endpointsEqual(endpoints, c.lastReporterState.endpoints) &&
+		c.lastReporterState.serviceConfig == c.serviceConfig &&
+		c.lastReporterState.clientLocality == c.clientLocality {
 		return false
 	}
 
-	c.lastReporterState.addresses = addrs
+	prevErr := c.lastReporterState.err
+
+	c.lastReporterState.endpoints = endpoints
+	c.lastReporterState.serviceConfig = c.serviceConfig
+	c.lastReporterState.clientLocality = c.clientLocality
 	c.lastReporterState.err = nil
 
-	err := c.cc.UpdateState(resolver.State{Addresses: addrs})
-	if err != nil && logger.V(2) {
+	if c.opts.debounce != 0 && c.stateReported && prevErr == nil {
+		c.debounceUpdate()
+		return true
+	}
+
+	c.sendState()
+
+	return true
+}
+
+// sendState reports c.lastReporterState to [c.cc.UpdateState] and discards
+// a pending debounced update.
+// c.mutex must be held when calling the method.
+func (c *consulResolver) sendState() {
+	c.stopDebounce()
+	c.stateReported = true
+
+	endpoints := c.lastReporterState.endpoints
+
+	// Addresses contains the first address of each endpoint, for
+	// balancers that do not support endpoints.
+	addrs := make([]resolver.Address, 0, len(endpoints))
+	for _, e := range endpoints {
+		addrs = append(addrs, e.Addresses[0])
+	}
+	addrs = slices.CompactFunc(addrs, func(e, e1 resolver.Address) bool {
+		return e.Addr == e1.Addr
+	})
+
+	c.metrics.StateReported(c.targetLabels, len(addrs))
+	c.addressesChanged(addrs)
+
+	var attrs *attributes.Attributes
+	if !c.lastReporterState.clientLocality.IsZero() {
+		attrs = LocalityAttributes(c.lastReporterState.clientLocality)
+	}
+
+	err := c.cc.UpdateState(resolver.State{
+		Addresses:     addrs,
+		Endpoints:     endpoints,
+		ServiceConfig: c.lastReporterState.serviceConfig,
+		Attributes:    attrs,
+	})
+	if err != nil {
 		// UpdateState errors can be ignored in
 		// watch-based resolvers, see
 		// https://github.com/grpc/grpc-go/issues/5048
 		// for a detailed explanation.
-		logger.Infof("ignoring error returned by UpdateState: %s", err)
+		c.log.Debug("ignoring error returned by UpdateState", errAttr(err))
 	}
-
-	return true
 }
 
-func (c *consulResolver) reportError(err error) bool {
+// updateError reports err to [c.cc.ReportError] if it differs from the
+// previous reported error.
+// c.mutex must be held when calling the method.
+func (c *consulResolver) updateError(err error) bool {
 	// We compare the string representation of the errors because it is
 	// simple and works. http.Client.Do() returns [*url.Error]s which are not
 	// equal when compared with "==", neither [url.Error.Err] does because
@@ -291,21 +1097,44 @@ func (c *consulResolver) reportError(err error) bool {
 		return false
 	}
 
-	c.lastReporterState.addresses = nil
+	c.stopDebounce()
+
+	c.lastReporterState.endpoints = nil
 	c.lastReporterState.err = err
 
+	c.metrics.ErrorReported(c.targetLabels)
 	c.cc.ReportError(err)
+
 	return true
 }
 
 func (c *consulResolver) ResolveNow(resolver.ResolveNowOptions) {
+	for _, svc := range c.services {
+		svc.triggerResolve()
+	}
+}
+
+func (s *serviceWatcher) triggerResolve() {
 	select {
-	case c.resolveNow <- struct{}{}:
+	case s.resolveNow <- struct{}{}:
 	default:
 	}
 }
 
 func (c *consulResolver) Close() {
+	if c.onClose != nil {
+		c.onClose()
+	}
+
 	c.cancel()
 	c.wgStop.Wait()
+
+	c.mutex.Lock()
+	for _, svc := range c.services {
+		svc.stopGracePeriod()
+		svc.stopShrinkHold()
+	}
+	c.stopDebounce()
+	c.stopInitialResolveTimer()
+	c.mutex.Unlock()
 }
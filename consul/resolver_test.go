@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"os"
+	"reflect"
+	"slices"
 	"testing"
 	"time"
 
@@ -24,6 +27,41 @@ func replaceCreateHealthClientFn(fn func(cfg *consul.Config) (consulHealthEndpoi
 	}
 }
 
+func replaceCreateAgentClientFn(fn func(cfg *consul.Config) (consulAgentEndpoint, error)) func() {
+	old := consulCreateAgentClientFn
+
+	consulCreateAgentClientFn = fn
+
+	return func() {
+		consulCreateAgentClientFn = old
+	}
+}
+
+func replaceCreateCatalogClientFn(fn func(cfg *consul.Config) (consulCatalogEndpoint, error)) func() {
+	old := consulCreateCatalogClientFn
+
+	consulCreateCatalogClientFn = fn
+
+	return func() {
+		consulCreateCatalogClientFn = old
+	}
+}
+
+// TestMain replaces the catalog client with a mock that fails, to prevent that
+// tests query a Consul agent that runs on the host when a service has no
+// instances. Tests that check the registration of services replace it with
+// their own mock.
+func TestMain(m *testing.M) {
+	catalog := mocks.NewConsulCatalogClient()
+	catalog.SetRespError(errors.New("catalog is not available in tests"))
+
+	consulCreateCatalogClientFn = func(*consul.Config) (consulCatalogEndpoint, error) {
+		return catalog, nil
+	}
+
+	os.Exit(m.Run())
+}
+
 func asHasEntry(agentServices []*consul.AgentService, addr *resolver.Address) bool {
 	for _, as := range agentServices {
 		if fmt.Sprintf("%s:%d", as.Address, as.Port) == addr.Addr {
@@ -85,6 +123,27 @@ func cmpAddrs(addrsA, addrsB []resolver.Address) bool {
 	return true
 }
 
+// waitFor polls cond until it returns true. If it does not within 5
+// seconds, the test fails with the message built from format and args.
+func waitFor(t *testing.T, cond func() bool, format string, args ...any) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for !cond() {
+		select {
+		case <-timeout:
+			t.Fatalf(format, args...)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func waitForAddrs(t *testing.T, cc *mocks.ClientConn, want []resolver.Address) {
+	t.Helper()
+
+	waitFor(t, func() bool { return cmpAddrs(cc.Addrs(), want) }, "resolved addresses did not change to: %+v", want)
+}
+
 func TestResolve(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -241,6 +300,88 @@ func TestResolve(t *testing.T) {
 				},
 			},
 		},
+
+		{
+			name:   "anyTags",
+			target: resolver.Target{URL: url.URL{Path: "web-service", RawQuery: "anyTags=blue,green"}},
+			consulResponse: []*consul.ServiceEntry{
+				{Service: &consul.AgentService{Address: "blue", Port: 1, Tags: []string{"blue"}}},
+				{Service: &consul.AgentService{Address: "green", Port: 1, Tags: []string{"primary", "green"}}},
+				{Service: &consul.AgentService{Address: "red", Port: 1, Tags: []string{"red"}}},
+				{Service: &consul.AgentService{Address: "untagged", Port: 1}},
+			},
+			resolverResult: []resolver.Address{
+				{Addr: "blue:1"},
+				{Addr: "green:1"},
+			},
+		},
+
+		{
+			name:   "excludeTags",
+			target: resolver.Target{URL: url.URL{Path: "web-service", RawQuery: "excludeTags=canary,draining"}},
+			consulResponse: []*consul.ServiceEntry{
+				{Service: &consul.AgentService{Address: "canary", Port: 1, Tags: []string{"primary", "canary"}}},
+				{Service: &consul.AgentService{Address: "draining", Port: 1, Tags: []string{"draining"}}},
+				{Service: &consul.AgentService{Address: "primary", Port: 1, Tags: []string{"primary"}}},
+				{Service: &consul.AgentService{Address: "untagged", Port: 1}},
+			},
+			resolverResult: []resolver.Address{
+				{Addr: "primary:1"},
+				{Addr: "untagged:1"},
+			},
+		},
+
+		{
+			name:   "anyTagsAndExcludeTags",
+			target: resolver.Target{URL: url.URL{Path: "web-service", RawQuery: "anyTags=blue,green&excludeTags=canary"}},
+			consulResponse: []*consul.ServiceEntry{
+				{Service: &consul.AgentService{Address: "blue", Port: 1, Tags: []string{"blue"}}},
+				{Service: &consul.AgentService{Address: "green-canary", Port: 1, Tags: []string{"green", "canary"}}},
+				{Service: &consul.AgentService{Address: "red", Port: 1, Tags: []string{"red"}}},
+			},
+			resolverResult: []resolver.Address{
+				{Addr: "blue:1"},
+			},
+		},
+
+		{
+			name:   "portMeta",
+			target: resolver.Target{URL: url.URL{Path: "web-service", RawQuery: "portMeta=grpc_port"}},
+			consulResponse: []*consul.ServiceEntry{
+				{Service: &consul.AgentService{ID: "1", Address: "localhost", Port: 80, Meta: map[string]string{"grpc_port": "9000"}}},
+				{Service: &consul.AgentService{ID: "2", Address: "remotehost", Port: 80}},
+				{Service: &consul.AgentService{ID: "3", Address: "otherhost", Port: 80, Meta: map[string]string{"grpc_port": "grpc"}}},
+				{Service: &consul.AgentService{ID: "4", Address: "farhost", Port: 80, Meta: map[string]string{"grpc_port": "70000"}}},
+			},
+			resolverResult: []resolver.Address{
+				{Addr: "localhost:9000"},
+			},
+		},
+
+		{
+			name:   "noAddress",
+			target: resolver.Target{URL: url.URL{Path: "web-service"}},
+			consulResponse: []*consul.ServiceEntry{
+				{Service: &consul.AgentService{ID: "1", Address: "localhost", Port: 80}},
+				{Service: &consul.AgentService{ID: "2", Port: 80}},
+			},
+			resolverResult: []resolver.Address{
+				{Addr: "localhost:80"},
+			},
+		},
+
+		{
+			name:   "port",
+			target: resolver.Target{URL: url.URL{Path: "web-service", RawQuery: "port=9000"}},
+			consulResponse: []*consul.ServiceEntry{
+				{Service: &consul.AgentService{Address: "localhost", Port: 80}},
+				{Service: &consul.AgentService{Address: "remotehost", Port: 81}},
+			},
+			resolverResult: []resolver.Address{
+				{Addr: "localhost:9000"},
+				{Addr: "remotehost:9000"},
+			},
+		},
 	}
 
 	health := mocks.NewConsulHealthClient()
@@ -281,6 +422,63 @@ func TestResolve(t *testing.T) {
 	}
 }
 
+func TestFilterTags(t *testing.T) {
+	entries := []*consul.ServiceEntry{
+		{Service: &consul.AgentService{ID: "blue", Tags: []string{"blue"}}},
+		{Service: &consul.AgentService{ID: "green-canary", Tags: []string{"green", "canary"}}},
+		{Service: &consul.AgentService{ID: "blue-draining", Tags: []string{"blue", "draining"}}},
+		{Service: &consul.AgentService{ID: "untagged"}},
+	}
+
+	tests := []struct {
+		name        string
+		anyTags     []string
+		excludeTags []string
+		wantIDs     []string
+	}{
+		{
+			name:    "noFilter",
+			wantIDs: []string{"blue", "green-canary", "blue-draining", "untagged"},
+		},
+		{
+			name:    "anyTags",
+			anyTags: []string{"blue", "green"},
+			wantIDs: []string{"blue", "green-canary", "blue-draining"},
+		},
+		{
+			name:    "anyTagsNoMatch",
+			anyTags: []string{"red"},
+			wantIDs: []string{},
+		},
+		{
+			name:        "excludeTags",
+			excludeTags: []string{"canary", "draining"},
+			wantIDs:     []string{"blue", "untagged"},
+		},
+		{
+			name:        "anyTagsAndExcludeTags",
+			anyTags:     []string{"blue", "green"},
+			excludeTags: []string{"draining"},
+			wantIDs:     []string{"blue", "green-canary"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := filterTags(entries, tt.anyTags, tt.excludeTags)
+
+			ids := make([]string, 0, len(result))
+			for _, e := range result {
+				ids = append(ids, e.Service.ID)
+			}
+
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("filterTags() returned %v, expected: %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
 func TestResolveNewAddressOnlyCalledOnChange(t *testing.T) {
 	health := mocks.NewConsulHealthClient()
 	cleanup := replaceCreateHealthClientFn(
@@ -612,6 +810,95 @@ func TestRetryOnError(t *testing.T) {
 	}
 }
 
+func TestRetryBackoffSequence(t *testing.T) {
+	cc := mocks.NewClientConn()
+	clk := mocks.NewClock()
+	health := mocks.NewConsulHealthClient()
+	cleanup := replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	)
+	t.Cleanup(cleanup)
+
+	health.SetRespError(errors.New("ERROR"))
+
+	// the backoff of the watcher is seeded with the same time, it
+	// returns the same jittered intervals
+	wantBackoff := defaultBackoff(clk)
+
+	r, err := NewBuilder(withClock(clk)).Build(resolver.Target{URL: url.URL{Path: "test"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+
+	t.Cleanup(r.Close)
+
+	for i := range len(wantBackoff.intervals) + 2 {
+		clk.WaitForTimers(1)
+
+		if cnt := health.ResolveCount(); cnt != i+1 {
+			t.Fatalf("resolve count is %d after %d retries, expected %d", cnt, i, i+1)
+		}
+
+		d := wantBackoff.Backoff(i)
+
+		clk.Advance(d - time.Nanosecond)
+		if clk.TimerCount() != 1 {
+			t.Fatalf("retry %d happened before the backoff of %s expired", i+1, d)
+		}
+
+		clk.Advance(time.Nanosecond)
+	}
+
+	clk.WaitForTimers(1)
+	if cnt := cc.ReportErrorCallCnt(); cnt != 1 {
+		t.Errorf("ReportError was called %d times for the same error, expected 1", cnt)
+	}
+}
+
+func TestTooFastResponsesAreDelayed(t *testing.T) {
+	cc := mocks.NewClientConn()
+	clk := mocks.NewClock()
+	health := mocks.NewConsulHealthClient()
+	cleanup := replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	)
+	t.Cleanup(cleanup)
+
+	health.SetRespServiceEntries([]*consul.AgentService{{Address: "10.0.0.1", Port: 1}})
+
+	r, err := NewBuilder(withClock(clk)).Build(resolver.Target{URL: url.URL{Path: "test"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+
+	t.Cleanup(r.Close)
+
+	waitForAddrs(t, cc, []resolver.Address{{Addr: "10.0.0.1:1"}})
+
+	// the mock responds immediately with the same data and index,
+	// every following query must be delayed by 50ms
+	r.ResolveNow(resolver.ResolveNowOptions{})
+
+	for i := range 3 {
+		clk.WaitForTimers(1)
+
+		if cnt := health.ResolveCount(); cnt != i+2 {
+			t.Fatalf("resolve count is %d, expected %d", cnt, i+2)
+		}
+
+		clk.Advance(49 * time.Millisecond)
+		if cnt := health.ResolveCount(); cnt != i+2 {
+			t.Fatalf("query was repeated after 49ms, resolve count is %d", cnt)
+		}
+
+		clk.Advance(time.Millisecond)
+	}
+}
+
 func TestErrorsOnlyReportedOnce(t *testing.T) {
 	var qe1 error = &url.Error{
 		Op:  "test",
@@ -667,3 +954,396 @@ func TestErrorsOnlyReportedOnce(t *testing.T) {
 		t.Errorf("ReportError was called %d times, expecting 1 call", cc.ReportErrorCallCnt())
 	}
 }
+
+func TestResolveMultipleServices(t *testing.T) {
+	responses := map[string][]*consul.ServiceEntry{
+		"payments-v1": {
+			{Service: &consul.AgentService{Address: "10.0.0.1", Port: 1}},
+			{Service: &consul.AgentService{Address: "10.0.0.2", Port: 1}},
+		},
+		"payments-v2": {
+			{Service: &consul.AgentService{Address: "10.0.0.2", Port: 1}},
+			{Service: &consul.AgentService{Address: "10.0.0.3", Port: 1}},
+		},
+	}
+
+	health := mocks.NewConsulHealthClient()
+	health.ServiceMultipleTagsFn = func(c *mocks.ConsulHealthClient, service string, _ []string, _ bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+		c.Mutex.Lock()
+		defer c.Mutex.Unlock()
+		c.ResolveCnt++
+
+		if q.Context().Err() != nil {
+			return nil, nil, q.Context().Err()
+		}
+
+		return responses[service], &consul.QueryMeta{}, nil
+	}
+
+	cleanup := replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	)
+	t.Cleanup(cleanup)
+
+	cc := mocks.NewClientConn()
+	target := resolver.Target{URL: url.URL{Path: "payments-v1,payments-v2"}}
+
+	r, err := NewBuilder().Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	want := []resolver.Address{
+		{Addr: "10.0.0.1:1"},
+		{Addr: "10.0.0.2:1"},
+		{Addr: "10.0.0.3:1"},
+	}
+
+	for len(cc.Addrs()) != len(want) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if addrs := cc.Addrs(); !cmpAddrs(addrs, want) {
+		t.Errorf("resolved address '%+v', expected: '%+v'", addrs, want)
+	}
+}
+
+func TestResolveMultipleServicesFailureIsolation(t *testing.T) {
+	queryErr := errors.New("query failed")
+
+	health := mocks.NewConsulHealthClient()
+	health.ServiceMultipleTagsFn = func(c *mocks.ConsulHealthClient, service string, _ []string, _ bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+		c.Mutex.Lock()
+		defer c.Mutex.Unlock()
+		c.ResolveCnt++
+
+		if q.Context().Err() != nil {
+			return nil, nil, q.Context().Err()
+		}
+
+		if service == "payments-v1" {
+			return nil, nil, queryErr
+		}
+
+		return []*consul.ServiceEntry{
+			{Service: &consul.AgentService{Address: "10.0.0.3", Port: 1}},
+		}, &consul.QueryMeta{}, nil
+	}
+
+	cleanup := replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	)
+	t.Cleanup(cleanup)
+
+	cc := mocks.NewClientConn()
+	target := resolver.Target{URL: url.URL{Path: "payments-v1,payments-v2"}}
+
+	r, err := NewBuilder().Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	for len(cc.Addrs()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	reportErrorCallCnt := cc.ReportErrorCallCnt()
+	resolveCnt := health.ResolveCount()
+	for health.ResolveCount() < resolveCnt+3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	want := []resolver.Address{{Addr: "10.0.0.3:1"}}
+	if addrs := cc.Addrs(); !cmpAddrs(addrs, want) {
+		t.Errorf("resolved address '%+v', expected: '%+v'", addrs, want)
+	}
+
+	if cc.ReportErrorCallCnt() != reportErrorCallCnt {
+		t.Errorf("ReportError was called %d times after the addresses of payments-v2 were reported, expecting no calls",
+			cc.ReportErrorCallCnt()-reportErrorCallCnt)
+	}
+}
+
+func TestResolveTranslatesToWANAddrInRemoteDatacenter(t *testing.T) {
+	tests := []struct {
+		name           string
+		rawQuery       string
+		resolverResult []resolver.Address
+	}{
+		{
+			name:     "translateWAN",
+			rawQuery: "dc=dc2",
+			resolverResult: []resolver.Address{
+				{Addr: "10.0.0.1:1"},
+				{Addr: "203.0.113.2:1"},
+			},
+		},
+		{
+			name:     "translateWANLANIPv6",
+			rawQuery: "dc=dc2&address=lan_ipv6",
+			resolverResult: []resolver.Address{
+				{Addr: "10.0.0.1:1"},
+				{Addr: "[2001:db8::2]:1"},
+			},
+		},
+		{
+			name:     "translateWANDisabled",
+			rawQuery: "dc=dc2&translateWAN=false",
+			resolverResult: []resolver.Address{
+				{Addr: "10.0.0.1:1"},
+				{Addr: "10.0.0.2:1"},
+			},
+		},
+	}
+
+	health := mocks.NewConsulHealthClient()
+	health.SetRespEntries([]*consul.ServiceEntry{
+		{
+			Node: &consul.Node{
+				Address:    "10.0.0.1",
+				Datacenter: "dc1",
+				TaggedAddresses: map[string]string{
+					"wan": "203.0.113.1",
+				},
+			},
+			Service: &consul.AgentService{Port: 1},
+		},
+		{
+			Node: &consul.Node{
+				Address:    "10.0.0.2",
+				Datacenter: "dc2",
+				TaggedAddresses: map[string]string{
+					"wan":      "203.0.113.2",
+					"wan_ipv6": "2001:db8::2",
+				},
+			},
+			Service: &consul.AgentService{Port: 1},
+		},
+	})
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	agent := mocks.NewConsulAgentClient("dc1")
+	t.Cleanup(replaceCreateAgentClientFn(
+		func(*consul.Config) (consulAgentEndpoint, error) {
+			return agent, nil
+		},
+	))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := mocks.NewClientConn()
+			target := resolver.Target{URL: url.URL{Path: "user-service", RawQuery: tt.rawQuery}}
+
+			r, err := NewBuilder().Build(target, cc, resolver.BuildOptions{})
+			if err != nil {
+				t.Fatal("Build() failed:", err.Error())
+			}
+			t.Cleanup(r.Close)
+
+			for cc.UpdateStateCallCnt() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			if addrs := cc.Addrs(); !cmpAddrs(addrs, tt.resolverResult) {
+				t.Errorf("resolved address '%+v', expected: '%+v'", addrs, tt.resolverResult)
+			}
+		})
+	}
+}
+
+func TestResolveWithoutAgentDatacenterUsesLANAddr(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	health.SetRespEntries([]*consul.ServiceEntry{
+		{
+			Node: &consul.Node{
+				Address:         "10.0.0.2",
+				Datacenter:      "dc2",
+				TaggedAddresses: map[string]string{"wan": "203.0.113.2"},
+			},
+			Service: &consul.AgentService{Port: 1},
+		},
+	})
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	agent := mocks.NewConsulAgentClient("dc1")
+	agent.SetRespError(errors.New("agent unavailable"))
+	t.Cleanup(replaceCreateAgentClientFn(
+		func(*consul.Config) (consulAgentEndpoint, error) {
+			return agent, nil
+		},
+	))
+
+	cc := mocks.NewClientConn()
+	target := resolver.Target{URL: url.URL{Path: "user-service", RawQuery: "dc=dc2"}}
+
+	r, err := NewBuilder().Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	for cc.UpdateStateCallCnt() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	want := []resolver.Address{{Addr: "10.0.0.2:1"}}
+	if addrs := cc.Addrs(); !cmpAddrs(addrs, want) {
+		t.Errorf("resolved address '%+v', expected: '%+v'", addrs, want)
+	}
+}
+
+func TestResolveDualStackInstanceToOneEndpoint(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	health.SetRespEntries([]*consul.ServiceEntry{
+		{
+			Node: &consul.Node{
+				Address: "10.0.0.1",
+				TaggedAddresses: map[string]string{
+					"lan_ipv4": "10.0.0.1",
+					"lan_ipv6": "fd00::1",
+				},
+			},
+			Service: &consul.AgentService{ID: "user-service-1", Port: 1},
+		},
+		{
+			Node:    &consul.Node{Address: "10.0.0.2"},
+			Service: &consul.AgentService{ID: "user-service-2", Port: 1},
+		},
+	})
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	cc := mocks.NewClientConn()
+	target := resolver.Target{URL: url.URL{Path: "user-service", RawQuery: "port=2"}}
+
+	r, err := NewBuilder().Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	for cc.UpdateStateCallCnt() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	wantEndpoints := []resolver.Endpoint{
+		{Addresses: []resolver.Address{{Addr: "10.0.0.1:2"}, {Addr: "[fd00::1]:2"}}},
+		{Addresses: []resolver.Address{{Addr: "10.0.0.2:2"}}},
+	}
+	if endpoints := cc.Endpoints(); slices.CompareFunc(endpoints, wantEndpoints, compareEndpoints) != 0 {
+		t.Errorf("resolved endpoints '%+v', expected: '%+v'", endpoints, wantEndpoints)
+	}
+
+	wantAddrs := []resolver.Address{{Addr: "10.0.0.1:2"}, {Addr: "10.0.0.2:2"}}
+	if addrs := cc.Addrs(); !cmpAddrs(addrs, wantAddrs) {
+		t.Errorf("resolved address '%+v', expected: '%+v'", addrs, wantAddrs)
+	}
+}
+
+func TestResolveLocality(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	health.SetRespEntries([]*consul.ServiceEntry{
+		{
+			Node: &consul.Node{
+				Address: "10.0.0.1",
+				Meta:    map[string]string{"region": "eu-central-1", "zone": "eu-central-1a"},
+			},
+			Service: &consul.AgentService{Port: 1},
+		},
+		{
+			Node: &consul.Node{
+				Address: "10.0.0.2",
+				Meta:    map[string]string{"region": "eu-central-1", "zone": "eu-central-1a"},
+			},
+			Service: &consul.AgentService{
+				Port: 1,
+				Meta: map[string]string{"zone": "eu-central-1b"},
+			},
+		},
+	})
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	agent := mocks.NewConsulAgentClient("dc1")
+	agent.SetNodeMeta(map[string]string{"region": "eu-central-1", "zone": "eu-central-1b"})
+	t.Cleanup(replaceCreateAgentClientFn(
+		func(*consul.Config) (consulAgentEndpoint, error) {
+			return agent, nil
+		},
+	))
+
+	tests := []struct {
+		name       string
+		builder    resolver.Builder
+		wantClient Locality
+	}{
+		{
+			name:       "clientLocalityFromAgent",
+			builder:    NewBuilder(),
+			wantClient: Locality{Region: "eu-central-1", Zone: "eu-central-1b"},
+		},
+		{
+			name:       "clientLocalityFromBuilder",
+			builder:    NewBuilder(WithLocality(Locality{Region: "us-east-1", Zone: "us-east-1a"})),
+			wantClient: Locality{Region: "us-east-1", Zone: "us-east-1a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := mocks.NewClientConn()
+			target := resolver.Target{URL: url.URL{Path: "user-service", RawQuery: "regionMeta=region&zoneMeta=zone"}}
+
+			r, err := tt.builder.Build(target, cc, resolver.BuildOptions{})
+			if err != nil {
+				t.Fatal("Build() failed:", err.Error())
+			}
+			t.Cleanup(r.Close)
+
+			for cc.UpdateStateCallCnt() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			want := map[string]Locality{
+				"10.0.0.1:1": {Region: "eu-central-1", Zone: "eu-central-1a"},
+				"10.0.0.2:1": {Region: "eu-central-1", Zone: "eu-central-1b"},
+			}
+
+			for _, addr := range cc.Addrs() {
+				l, ok := LocalityFromAddress(addr)
+				if !ok {
+					t.Errorf("address %s has no locality", addr.Addr)
+					continue
+				}
+
+				if l != want[addr.Addr] {
+					t.Errorf("locality of address %s is %+v, expected: %+v", addr.Addr, l, want[addr.Addr])
+				}
+			}
+
+			if l, _ := LocalityFromState(cc.State()); l != tt.wantClient {
+				t.Errorf("client locality is %+v, expected: %+v", l, tt.wantClient)
+			}
+		})
+	}
+}
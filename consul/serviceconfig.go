@@ -0,0 +1,109 @@
+package consul
+
+import (
+	consul "github.com/hashicorp/consul/api"
+)
+
+type consulKVEndpoint interface {
+	Get(key string, q *consul.QueryOptions) (*consul.KVPair, *consul.QueryMeta, error)
+}
+
+// consulCreateKVClientFn can be overwritten in tests to make
+// newConsulResolver() return a different consulKVEndpoint implementation
+var consulCreateKVClientFn = func(cfg *consul.Config) (consulKVEndpoint, error) {
+	clt, err := consul.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return clt.KV(), nil
+}
+
+// serviceConfigKVWatcher monitors the Consul KV key c.opts.serviceConfigKey
+// with blocking queries and reports changes of its value via
+// c.setServiceConfig().
+func (c *consulResolver) serviceConfigKVWatcher() {
+	defer c.wgStop.Done()
+
+	source := "consul key '" + c.opts.serviceConfigKey + "'"
+
+	c.blockingQueryLoop(source, func(opts *consul.QueryOptions) (uint64, bool, error) {
+		pair, meta, err := c.consulKV.Get(c.opts.serviceConfigKey, opts)
+		if err != nil {
+			return 0, false, err
+		}
+
+		var js string
+		if pair != nil {
+			js = string(pair.Value)
+		}
+
+		return meta.LastIndex, c.setServiceConfig(source, js), nil
+	}, func(error) {
+		c.serviceConfigQueryFailed()
+	})
+}
+
+// serviceConfigQueryFailed is called when retrieving the service config from
+// Consul failed.
+// If no service config has been retrieved before, the addresses are reported
+// without a service config.
+func (c *consulResolver) serviceConfigQueryFailed() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.serviceConfigLoaded {
+		return
+	}
+
+	c.serviceConfigLoaded = true
+	c.updateStateIfResolved()
+}
+
+// setServiceConfig parses the JSON service config js and reports it
+// together with the addresses.
+// source describes where js was retrieved from, it is used in log messages.
+// If js is empty, the resolver reports no service config.
+// If js is invalid, the last valid service config is kept.
+// It returns true if the reported state changed.
+func (c *consulResolver) setServiceConfig(source, js string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.serviceConfigLoaded && c.serviceConfigJSON == js {
+		return false
+	}
+
+	c.serviceConfigLoaded = true
+	c.serviceConfigJSON = js
+
+	if js == "" {
+		c.log.Info("no service config found", "source", source)
+		c.serviceConfig = nil
+		return c.updateStateIfResolved()
+	}
+
+	cfg := c.cc.ParseServiceConfig(js)
+	if cfg.Err != nil {
+		c.log.Warn("service config is invalid, keeping previous config", "source", source, errAttr(cfg.Err))
+		return c.updateStateIfResolved()
+	}
+
+	c.log.Info("service config changed", "source", source, "service_config", js)
+	c.serviceConfig = cfg
+
+	return c.updateStateIfResolved()
+}
+
+// updateStateIfResolved calls c.updateState() if at least one of the services
+// has been resolved.
+// c.mutex must be held when calling the method.
+func (c *consulResolver) updateStateIfResolved() bool {
+	for _, svc := range c.services {
+		if svc.resolved {
+			return c.updateState()
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,131 @@
+package consul
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+func replaceCreateKVClientFn(fn func(cfg *consul.Config) (consulKVEndpoint, error)) func() {
+	old := consulCreateKVClientFn
+
+	consulCreateKVClientFn = fn
+
+	return func() {
+		consulCreateKVClientFn = old
+	}
+}
+
+func setupServiceConfigTest(t *testing.T) (*mocks.ConsulHealthClient, *mocks.ConsulKVClient) {
+	health := mocks.NewConsulHealthClient()
+	health.SetRespEntries([]*consul.ServiceEntry{
+		{
+			Service: &consul.AgentService{
+				Address: "localhost",
+				Port:    5678,
+			},
+		},
+	})
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	kv := mocks.NewConsulKVClient()
+	t.Cleanup(replaceCreateKVClientFn(
+		func(*consul.Config) (consulKVEndpoint, error) {
+			return kv, nil
+		},
+	))
+
+	return health, kv
+}
+
+func waitForServiceConfig(t *testing.T, cc *mocks.ClientConn, js string) {
+	t.Helper()
+
+	waitFor(t, func() bool { return cc.ServiceConfigJSON() == js }, "reported service config did not change to: %q", js)
+}
+
+func TestServiceConfigFromKV(t *testing.T) {
+	const cfg1 = `{"loadBalancingConfig": [{"round_robin":{}}]}`
+	const cfg2 = `{"methodConfig": [{"name": [{"service": "svc"}], "timeout": "1s"}]}`
+
+	_, kv := setupServiceConfigTest(t)
+	kv.SetValue("grpc/service-config/user-service", []byte(cfg1))
+
+	cc := mocks.NewClientConn()
+	target := resolver.Target{URL: url.URL{Path: "user-service", RawQuery: "serviceConfigKey=grpc/service-config/user-service"}}
+
+	r, err := NewBuilder().Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	waitFor(t, func() bool { return cc.UpdateStateCallCnt() > 0 }, "UpdateState was not called")
+
+	if cc.ServiceConfigJSON() != cfg1 {
+		t.Errorf("first reported service config is %q, expected: %q", cc.ServiceConfigJSON(), cfg1)
+	}
+
+	if len(cc.Addrs()) != 1 {
+		t.Errorf("resolved %d addresses, expected 1", len(cc.Addrs()))
+	}
+
+	t.Run("invalidConfigKeepsPrevious", func(t *testing.T) {
+		updateStateCallCnt := cc.UpdateStateCallCnt()
+		kv.SetValue("grpc/service-config/user-service", []byte("{"))
+
+		getCnt := kv.GetCallCnt()
+		waitFor(t, func() bool { return kv.GetCallCnt() >= getCnt+2 }, "service config was not queried again")
+
+		if cc.UpdateStateCallCnt() != updateStateCallCnt {
+			t.Errorf("UpdateState was called after an invalid service config was stored")
+		}
+
+		if cc.ServiceConfigJSON() != cfg1 {
+			t.Errorf("reported service config is %q, expected: %q", cc.ServiceConfigJSON(), cfg1)
+		}
+	})
+
+	t.Run("changedConfig", func(t *testing.T) {
+		kv.SetValue("grpc/service-config/user-service", []byte(cfg2))
+		waitForServiceConfig(t, cc, cfg2)
+	})
+
+	t.Run("deletedKey", func(t *testing.T) {
+		kv.SetValue("grpc/service-config/user-service", nil)
+		waitForServiceConfig(t, cc, "")
+	})
+}
+
+func TestAddressesAreReportedWhenServiceConfigQueryFails(t *testing.T) {
+	_, kv := setupServiceConfigTest(t)
+	kv.SetRespError(errors.New("permission denied"))
+
+	cc := mocks.NewClientConn()
+	target := resolver.Target{URL: url.URL{Path: "user-service", RawQuery: "serviceConfigKey=grpc/service-config/user-service"}}
+
+	r, err := NewBuilder().Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	waitFor(t, func() bool { return cc.UpdateStateCallCnt() > 0 }, "UpdateState was not called")
+
+	if len(cc.Addrs()) != 1 {
+		t.Errorf("resolved %d addresses, expected 1", len(cc.Addrs()))
+	}
+
+	if cc.ServiceConfigJSON() != "" {
+		t.Errorf("reported service config is %q, expected none", cc.ServiceConfigJSON())
+	}
+}
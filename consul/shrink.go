@@ -0,0 +1,163 @@
+package consul
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/clock"
+)
+
+const (
+	// defaultMaxShrinkWindow is the duration for that a shrink that exceeds
+	// maxShrink is held back, if none is configured.
+	defaultMaxShrinkWindow = 2 * time.Minute
+	// shrinkEmptyConfirmations is the number of consecutive queries that
+	// must return no instances, before the empty result is applied
+	// without waiting for the end of the window.
+	shrinkEmptyConfirmations = 3
+	// shrinkConfirmInterval is the interval in that a service is queried
+	// again while an empty result is held back.
+	shrinkConfirmInterval = 5 * time.Second
+)
+
+// heldShrink is a result of a service that removes more instances than
+// allowed by maxShrink and is held back.
+type heldShrink struct {
+	endpoints []resolver.Endpoint
+	// emptyCnt is the number of consecutive queries that returned no
+	// instances.
+	emptyCnt int
+	timer    clock.Timer
+}
+
+// parseMaxShrink parses a percentage in the format "<n>" or "<n>%", n must
+// be between 1 and 99.
+func parseMaxShrink(s string) (int, error) {
+	pct, err := strconv.Atoi(strings.TrimSuffix(s, "%"))
+	if err != nil || pct < 1 || pct > 99 {
+		return 0, fmt.Errorf("unsupported maxShrink parameter value: '%s'", s)
+	}
+
+	return pct, nil
+}
+
+// removedEndpoints returns the number of endpoints in old that are not in
+// endpoints. Endpoints are identified by their first address.
+func removedEndpoints(old, endpoints []resolver.Endpoint) int {
+	addrs := make(map[string]struct{}, len(endpoints))
+	for _, e := range endpoints {
+		addrs[e.Addresses[0].Addr] = struct{}{}
+	}
+
+	var removed int
+	for _, e := range old {
+		if _, exists := addrs[e.Addresses[0].Addr]; !exists {
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// guardShrink returns true if endpoints can be applied as new result of svc.
+// If they remove more than maxShrink percent of the current endpoints of
+// svc, they are held back and false is returned. The held back endpoints are
+// applied when the window expires, or when the service had no instances in
+// shrinkEmptyConfirmations consecutive queries.
+// c.mutex must be held when calling the method.
+func (c *consulResolver) guardShrink(svc *serviceWatcher, endpoints []resolver.Endpoint) bool {
+	if c.opts.maxShrink == 0 || !svc.resolved || len(svc.endpoints) == 0 {
+		svc.stopShrinkHold()
+		return true
+	}
+
+	removed := removedEndpoints(svc.endpoints, endpoints)
+	if removed*100 <= len(svc.endpoints)*c.opts.maxShrink {
+		if svc.shrink != nil {
+			svc.log.Info("instances of service recovered, releasing the held back result")
+			svc.stopShrinkHold()
+		}
+
+		return true
+	}
+
+	if svc.shrink == nil {
+		svc.log.Error("consul removed more instances than allowed by maxShrink, keeping the current instances",
+			"addr_count", len(endpoints),
+			"removed", removed,
+			"current_addr_count", len(svc.endpoints),
+			"max_shrink", c.opts.maxShrink,
+			"max_shrink_window", c.opts.maxShrinkWindow,
+		)
+
+		svc.shrink = &heldShrink{}
+		svc.shrink.timer = c.clock.AfterFunc(c.opts.maxShrinkWindow, func() {
+			c.shrinkWindowExpired(svc)
+		})
+	}
+
+	svc.shrink.endpoints = endpoints
+
+	if len(endpoints) != 0 {
+		svc.shrink.emptyCnt = 0
+		return false
+	}
+
+	svc.shrink.emptyCnt++
+	if svc.shrink.emptyCnt < shrinkEmptyConfirmations {
+		return false
+	}
+
+	svc.log.Error("consul returned no instances of service in consecutive queries, removing all instances",
+		"queries", svc.shrink.emptyCnt,
+	)
+	svc.stopShrinkHold()
+
+	return true
+}
+
+// awaitingShrinkConfirmation returns true if an empty result of svc is held
+// back and has to be confirmed by further queries.
+func (c *consulResolver) awaitingShrinkConfirmation(svc *serviceWatcher) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return svc.shrink != nil && len(svc.shrink.endpoints) == 0
+}
+
+// shrinkWindowExpired applies the held back result of svc.
+func (c *consulResolver) shrinkWindowExpired(svc *serviceWatcher) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.ctx.Err() != nil || svc.shrink == nil {
+		return
+	}
+
+	svc.log.Error("instances of service did not recover within maxShrinkWindow, applying the held back result",
+		"max_shrink_window", c.opts.maxShrinkWindow,
+		"addr_count", len(svc.shrink.endpoints),
+		"current_addr_count", len(svc.endpoints),
+	)
+
+	svc.endpoints = svc.shrink.endpoints
+	svc.stopShrinkHold()
+
+	c.updateState()
+	c.storeCache()
+}
+
+// stopShrinkHold discards the held back result of s.
+// consulResolver.mutex must be held when calling the method.
+func (s *serviceWatcher) stopShrinkHold() {
+	if s.shrink == nil {
+		return
+	}
+
+	s.shrink.timer.Stop()
+	s.shrink = nil
+}
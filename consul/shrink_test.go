@@ -0,0 +1,141 @@
+package consul
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+func serviceInstances(cnt int) ([]*consul.AgentService, []resolver.Address) {
+	services := make([]*consul.AgentService, 0, cnt)
+	addrs := make([]resolver.Address, 0, cnt)
+
+	for i := range cnt {
+		services = append(services, &consul.AgentService{Address: fmt.Sprintf("10.0.0.%d", i+1), Port: 1})
+		addrs = append(addrs, resolver.Address{Addr: fmt.Sprintf("10.0.0.%d:1", i+1)})
+	}
+
+	return services, addrs
+}
+
+func startShrinkTestResolver(t *testing.T, clk *mocks.Clock, rawQuery string) (*consulResolver, *mocks.ConsulHealthClient, *mocks.ClientConn, []resolver.Address) {
+	t.Helper()
+
+	health := mocks.NewConsulHealthClient()
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	services, addrs := serviceInstances(10)
+	health.SetRespServiceEntries(services)
+
+	cc := mocks.NewClientConn()
+	target := resolver.Target{URL: url.URL{Path: "user-service", RawQuery: rawQuery}}
+
+	r, err := NewBuilder(withClock(clk)).Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	waitForAddrs(t, cc, addrs)
+
+	// the mock responds with the same index, the watcher delays the next
+	// query because it returned too fast
+	clk.WaitForTimers(1)
+
+	return r.(*consulResolver), health, cc, addrs
+}
+
+func TestShrinkExceedingMaxShrinkIsAppliedAfterWindow(t *testing.T) {
+	const window = time.Minute
+
+	clk := mocks.NewClock()
+	_, health, cc, addrs := startShrinkTestResolver(t, clk, "maxShrink=50&maxShrinkWindow="+window.String())
+
+	services, shrunkAddrs := serviceInstances(2)
+	health.SetRespServiceEntries(services)
+	clk.Advance(50 * time.Millisecond)
+
+	// the maxShrink window and the delay of the next query
+	clk.WaitForTimers(2)
+	clk.Advance(window - time.Millisecond)
+
+	if !cmpAddrs(cc.Addrs(), addrs) {
+		t.Fatalf("addresses changed to %+v within the maxShrink window", cc.Addrs())
+	}
+
+	clk.Advance(time.Millisecond)
+	waitForAddrs(t, cc, shrunkAddrs)
+}
+
+func TestShrinkWithinMaxShrinkIsApplied(t *testing.T) {
+	clk := mocks.NewClock()
+	_, health, cc, _ := startShrinkTestResolver(t, clk, "maxShrink=50&maxShrinkWindow=1h")
+
+	services, addrs := serviceInstances(5)
+	health.SetRespServiceEntries(services)
+	clk.Advance(50 * time.Millisecond)
+
+	waitForAddrs(t, cc, addrs)
+}
+
+func TestShrinkIsDiscardedWhenInstancesRecover(t *testing.T) {
+	const window = time.Minute
+
+	clk := mocks.NewClock()
+	c, health, cc, addrs := startShrinkTestResolver(t, clk, "maxShrink=50&maxShrinkWindow="+window.String())
+
+	services, _ := serviceInstances(2)
+	health.SetRespServiceEntries(services)
+	clk.Advance(50 * time.Millisecond)
+
+	clk.WaitForTimers(2)
+
+	services, _ = serviceInstances(10)
+	health.SetRespServiceEntries(services)
+	clk.Advance(50 * time.Millisecond)
+
+	waitFor(t, func() bool {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		return c.services[0].shrink == nil
+	}, "held back result was not discarded when the instances recovered")
+
+	clk.Advance(window)
+
+	if !cmpAddrs(cc.Addrs(), addrs) {
+		t.Errorf("addresses are %+v after the instances recovered, expected %+v", cc.Addrs(), addrs)
+	}
+}
+
+func TestConfirmedEmptyResultIsApplied(t *testing.T) {
+	clk := mocks.NewClock()
+	_, health, cc, addrs := startShrinkTestResolver(t, clk, "maxShrink=50&maxShrinkWindow=1h")
+
+	health.SetRespServiceEntries(nil)
+	clk.Advance(50 * time.Millisecond)
+
+	for i := 1; i < shrinkEmptyConfirmations; i++ {
+		// the maxShrink window and the delay of the confirmation
+		// query
+		clk.WaitForTimers(2)
+
+		if !cmpAddrs(cc.Addrs(), addrs) {
+			t.Fatalf("addresses changed to %+v after %d empty results", cc.Addrs(), i)
+		}
+
+		clk.Advance(shrinkConfirmInterval)
+	}
+
+	waitForAddrs(t, cc, []resolver.Address{})
+}
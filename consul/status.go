@@ -0,0 +1,339 @@
+package consul
+
+import (
+	"cmp"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResolverStatus is the state of a resolver.
+type ResolverStatus struct {
+	// Target is the URL of the resolver target, the value of the token
+	// OPT is replaced with "redacted".
+	Target string `json:"target"`
+	// Options are the settings of the resolver that were parsed from the
+	// target URL, with the names of the URL OPTs. The token is omitted.
+	Options map[string]string `json:"options"`
+	// Addresses are the addresses that are reported to gRPC.
+	Addresses []string `json:"addresses"`
+	// LastError is the error that is reported to gRPC, it is empty if
+	// the addresses are reported.
+	LastError string          `json:"lastError,omitempty"`
+	Services  []ServiceStatus `json:"services"`
+	// Changes are the most recent changes of the reported addresses,
+	// ordered from the oldest to the newest.
+	Changes []AddressChange `json:"changes"`
+}
+
+// AddressChange is a change of the addresses that are reported to gRPC.
+type AddressChange struct {
+	Time    time.Time `json:"time"`
+	Added   []string  `json:"added,omitempty"`
+	Removed []string  `json:"removed,omitempty"`
+}
+
+// maxAddressChanges is the number of address changes of a resolver that are
+// kept for the status.
+const maxAddressChanges = 20
+
+// ServiceStatus is the query state of a service of a resolver.
+type ServiceStatus struct {
+	Name string `json:"name"`
+	// WaitIndex is the Consul index of the last successful query.
+	WaitIndex uint64 `json:"waitIndex"`
+	// RetryCount is the number of consecutive failed queries.
+	RetryCount int `json:"retryCount"`
+	// LastSuccess is the time of the last successful query, it is zero
+	// if no query succeeded yet.
+	LastSuccess time.Time `json:"lastSuccess"`
+	// LastError is the error of the last query, it is empty if it
+	// succeeded.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// register adds r to the resolvers of the builder, it is removed when r is
+// closed.
+func (b *Builder) register(r *consulResolver) {
+	b.resolversMutex.Lock()
+	defer b.resolversMutex.Unlock()
+
+	b.resolvers[r] = struct{}{}
+
+	r.onClose = func() {
+		b.resolversMutex.Lock()
+		defer b.resolversMutex.Unlock()
+
+		delete(b.resolvers, r)
+	}
+}
+
+// Snapshot returns the state of the resolvers that were built by b and are
+// not closed, sorted by target.
+func (b *Builder) Snapshot() []ResolverStatus {
+	b.resolversMutex.Lock()
+	resolvers := make([]*consulResolver, 0, len(b.resolvers))
+	for r := range b.resolvers {
+		resolvers = append(resolvers, r)
+	}
+	b.resolversMutex.Unlock()
+
+	result := make([]ResolverStatus, 0, len(resolvers))
+	for _, r := range resolvers {
+		result = append(result, r.status())
+	}
+
+	slices.SortFunc(result, func(a, b ResolverStatus) int {
+		return cmp.Compare(a.Target, b.Target)
+	})
+
+	return result
+}
+
+// status returns the current state of c.
+func (c *consulResolver) status() ResolverStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	result := ResolverStatus{
+		Target:    c.target,
+		Options:   c.opts.describe(),
+		Addresses: make([]string, 0, len(c.lastReporterState.endpoints)),
+		Services:  make([]ServiceStatus, 0, len(c.services)),
+		Changes:   slices.Clone(c.addressChanges),
+	}
+
+	for _, e := range c.lastReporterState.endpoints {
+		result.Addresses = append(result.Addresses, e.Addresses[0].Addr)
+	}
+
+	if c.lastReporterState.err != nil {
+		result.LastError = c.lastReporterState.err.Error()
+	}
+
+	for _, svc := range c.services {
+		s := ServiceStatus{
+			Name:        svc.name,
+			WaitIndex:   svc.waitIndex,
+			RetryCount:  svc.retryCount,
+			LastSuccess: svc.lastSuccess,
+		}
+
+		if svc.err != nil {
+			s.LastError = svc.err.Error()
+		}
+
+		result.Services = append(result.Services, s)
+	}
+
+	return result
+}
+
+// redactToken replaces the value of the token OPT in target with
+// "redacted".
+func redactToken(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+
+	q := u.Query()
+	for key := range q {
+		if strings.EqualFold(key, "token") {
+			q[key] = []string{"redacted"}
+			u.RawQuery = q.Encode()
+		}
+	}
+
+	return u.String()
+}
+
+// recordAddressChange records a change of the reported addresses for the
+// status, only the last maxAddressChanges changes are kept.
+// c.mutex must be held when calling the method.
+func (c *consulResolver) recordAddressChange(added, removed []string) {
+	if len(c.addressChanges) == maxAddressChanges {
+		c.addressChanges = slices.Delete(c.addressChanges, 0, 1)
+	}
+
+	c.addressChanges = append(c.addressChanges, AddressChange{
+		Time:    c.clock.Now(),
+		Added:   added,
+		Removed: removed,
+	})
+}
+
+// recordQueryStatus records the result of a query of svc for the status.
+// waitIndex is ignored if the query failed.
+func (c *consulResolver) recordQueryStatus(svc *serviceWatcher, retryCnt int, waitIndex uint64, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	svc.retryCount = retryCnt
+	if err == nil {
+		svc.waitIndex = waitIndex
+		svc.lastSuccess = c.clock.Now()
+	}
+}
+
+// describe returns the effective settings of o, keyed by the names of the
+// URL OPTs. Unset and disabled settings and the token are omitted.
+func (o *resolverOpts) describe() map[string]string {
+	result := map[string]string{}
+
+	set := func(key, value string) {
+		if value != "" {
+			result[key] = value
+		}
+	}
+
+	set("scheme", o.scheme)
+	set("tags", strings.Join(o.tags, ","))
+	set("anyTags", strings.Join(o.anyTags, ","))
+	set("excludeTags", strings.Join(o.excludeTags, ","))
+	set("dc", o.datacenter)
+	set("portMeta", o.portMeta)
+	set("serviceConfigKey", o.serviceConfigKey)
+	set("regionMeta", o.regionMeta)
+	set("zoneMeta", o.zoneMeta)
+
+	switch o.health {
+	case healthFilterOnlyHealthy:
+		set("health", "healthy")
+	case healthFilterFallbackToUnhealthy:
+		set("health", "fallbackToUnhealthy")
+	}
+
+	switch o.address {
+	case addressTypeService:
+		set("address", "service")
+	case addressTypeNode:
+		set("address", "node")
+	default:
+		set("address", taggedAddressKeys[o.address])
+	}
+
+	switch o.transport {
+	case transportHTTP:
+		set("transport", "http")
+	case transportDNS:
+		set("transport", "dns")
+	}
+
+	switch o.errorPolicy {
+	case ErrorPolicyReportError:
+		set("onError", "reportError")
+	case ErrorPolicyKeepLastState:
+		set("onError", "keepLastState")
+		set("errorGracePeriod", o.errorGracePeriod.String())
+	}
+
+	set("translateWAN", strconv.FormatBool(o.translateWAN))
+
+	if o.port != 0 {
+		set("port", strconv.Itoa(o.port))
+	}
+
+	if o.serviceConfigFromConfigEntries {
+		set("serviceConfigFromConfigEntries", "true")
+	}
+
+	if o.useSubset {
+		result["subset"] = o.subset
+	}
+
+	if o.subsetSize != 0 {
+		set("subsetSize", strconv.Itoa(o.subsetSize))
+	}
+
+	if o.maxShrink != 0 {
+		set("maxShrink", strconv.Itoa(o.maxShrink))
+		set("maxShrinkWindow", o.maxShrinkWindow.String())
+	}
+
+	if o.debounce != 0 {
+		set("debounce", o.debounce.String())
+		set("debounceMaxDelay", o.debounceMaxDelay.String())
+	}
+
+	if o.initialResolveTimeout != 0 {
+		set("initialResolveTimeout", o.initialResolveTimeout.String())
+	}
+
+	return result
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Consul Resolvers</title></head>
+<body>
+<h1>Consul Resolvers</h1>
+{{- range .}}
+<h2>{{.Target}}</h2>
+<table>
+{{- range $key, $value := .Options}}
+<tr><th align="left">{{$key}}</th><td>{{$value}}</td></tr>
+{{- end}}
+</table>
+{{- if .LastError}}
+<p>Error: {{.LastError}}</p>
+{{- end}}
+<h3>Addresses</h3>
+<ul>
+{{- range .Addresses}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+<h3>Services</h3>
+<table>
+<tr><th>Name</th><th>WaitIndex</th><th>Retries</th><th>Last Success</th><th>Last Error</th></tr>
+{{- range .Services}}
+<tr><td>{{.Name}}</td><td>{{.WaitIndex}}</td><td>{{.RetryCount}}</td><td>{{if not .LastSuccess.IsZero}}{{.LastSuccess}}{{end}}</td><td>{{.LastError}}</td></tr>
+{{- end}}
+</table>
+{{- if .Changes}}
+<h3>Recent Changes</h3>
+<table>
+<tr><th>Time</th><th>Added</th><th>Removed</th></tr>
+{{- range .Changes}}
+<tr><td>{{.Time}}</td><td>{{range .Added}}{{.}} {{end}}</td><td>{{range .Removed}}{{.}} {{end}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- else}}
+<p>No active resolvers.</p>
+{{- end}}
+</body>
+</html>
+`))
+
+// StatusHandler returns an [http.Handler] that renders the [Builder.Snapshot]
+// as HTML page. If the request has the query parameter format=json or
+// accepts application/json, it is rendered as JSON.
+func (b *Builder) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshot := b.Snapshot()
+
+		if r.URL.Query().Get("format") == "json" ||
+			strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+
+			if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+				newLogger(b.logger).Warn("writing resolver status failed", errAttr(err))
+			}
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+		if err := statusTemplate.Execute(w, snapshot); err != nil {
+			newLogger(b.logger).Warn("writing resolver status failed", errAttr(err))
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+func TestSnapshot(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	health.SetRespServiceEntries([]*consul.AgentService{{Address: "10.0.0.1", Port: 1}})
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	builder := NewBuilder()
+
+	cc1 := mocks.NewClientConn()
+	r1, err := builder.Build(
+		resolver.Target{URL: url.URL{Scheme: "consul", Path: "/user-service", RawQuery: "token=secret&tags=primary"}},
+		cc1, resolver.BuildOptions{},
+	)
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r1.Close)
+
+	cc2 := mocks.NewClientConn()
+	r2, err := builder.Build(
+		resolver.Target{URL: url.URL{Scheme: "consul", Path: "/billing-service"}},
+		cc2, resolver.BuildOptions{},
+	)
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+
+	waitForAddrs(t, cc1, []resolver.Address{{Addr: "10.0.0.1:1"}})
+	waitForAddrs(t, cc2, []resolver.Address{{Addr: "10.0.0.1:1"}})
+
+	snapshot := builder.Snapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("snapshot contains %d resolvers, expected 2", len(snapshot))
+	}
+
+	s := snapshot[1]
+	if s.Target != "consul:///user-service?tags=primary&token=redacted" {
+		t.Fatalf("second target of the snapshot is %s, expected the user-service target with redacted token", s.Target)
+	}
+
+	if !reflect.DeepEqual(s.Addresses, []string{"10.0.0.1:1"}) {
+		t.Errorf("snapshot addresses are %v, expected [10.0.0.1:1]", s.Addresses)
+	}
+
+	if s.Options["tags"] != "primary" {
+		t.Errorf("snapshot option tags is %q, expected primary", s.Options["tags"])
+	}
+
+	if _, exists := s.Options["token"]; exists {
+		t.Error("snapshot options contain the token")
+	}
+
+	if len(s.Services) != 1 || s.Services[0].Name != "user-service" ||
+		s.Services[0].LastSuccess.IsZero() || s.Services[0].RetryCount != 0 {
+		t.Errorf("unexpected service status: %+v", s.Services)
+	}
+
+	r2.Close()
+
+	if snapshot := builder.Snapshot(); len(snapshot) != 1 || snapshot[0].Target != s.Target {
+		t.Errorf("snapshot after closing a resolver is %+v, expected only the user-service resolver", snapshot)
+	}
+
+	t.Run("statusHandler", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		builder.StatusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/?format=json", nil))
+
+		var got []ResolverStatus
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal("decoding JSON response failed:", err)
+		}
+
+		if len(got) != 1 || got[0].Target != s.Target {
+			t.Errorf("unexpected JSON response: %+v", got)
+		}
+
+		rec = httptest.NewRecorder()
+		builder.StatusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("content type of HTML response is %q", ct)
+		}
+
+		if body := rec.Body.String(); !strings.Contains(body, "consul:///user-service") || strings.Contains(body, "secret") || !strings.Contains(body, "10.0.0.1:1") {
+			t.Errorf("HTML response does not contain the resolver: %s", body)
+		}
+	})
+}
+
+func TestSnapshotRecordsRetries(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	health.SetRespError(consul.StatusError{Code: 500, Body: "rpc error"})
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	clk := mocks.NewClock()
+	builder := NewBuilder(withClock(clk))
+
+	r, err := builder.Build(resolver.Target{URL: url.URL{Path: "user-service"}}, mocks.NewClientConn(), resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	for range 2 {
+		clk.WaitForTimers(1)
+		clk.Advance(time.Minute)
+	}
+	clk.WaitForTimers(1)
+
+	s := builder.Snapshot()[0]
+	if s.LastError == "" {
+		t.Error("snapshot has no error")
+	}
+
+	if svc := s.Services[0]; svc.RetryCount != 3 || svc.LastError == "" || !svc.LastSuccess.IsZero() {
+		t.Errorf("unexpected service status: %+v", svc)
+	}
+}
+
+func TestSnapshotRecordsAddressChanges(t *testing.T) {
+	health := mocks.NewConsulHealthClient()
+	health.SetRespServiceEntries([]*consul.AgentService{
+		{Address: "10.0.0.1", Port: 1},
+		{Address: "10.0.0.2", Port: 1},
+	})
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	clk := mocks.NewClock()
+	builder := NewBuilder(withClock(clk))
+	cc := mocks.NewClientConn()
+
+	r, err := builder.Build(resolver.Target{URL: url.URL{Path: "user-service"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	waitForAddrs(t, cc, []resolver.Address{{Addr: "10.0.0.1:1"}, {Addr: "10.0.0.2:1"}})
+
+	health.SetRespServiceEntries([]*consul.AgentService{
+		{Address: "10.0.0.2", Port: 1},
+		{Address: "10.0.0.3", Port: 1},
+	})
+	// release the watcher that delays the next query because the mock
+	// responded too fast with unchanged data
+	clk.Advance(time.Minute)
+
+	waitForAddrs(t, cc, []resolver.Address{{Addr: "10.0.0.2:1"}, {Addr: "10.0.0.3:1"}})
+
+	changes := builder.Snapshot()[0].Changes
+	if len(changes) != 2 {
+		t.Fatalf("snapshot contains %d address changes, expected 2: %+v", len(changes), changes)
+	}
+
+	if !reflect.DeepEqual(changes[0].Added, []string{"10.0.0.1:1", "10.0.0.2:1"}) || changes[0].Removed != nil {
+		t.Errorf("unexpected first address change: %+v", changes[0])
+	}
+
+	if !reflect.DeepEqual(changes[1].Added, []string{"10.0.0.3:1"}) ||
+		!reflect.DeepEqual(changes[1].Removed, []string{"10.0.0.1:1"}) {
+		t.Errorf("unexpected second address change: %+v", changes[1])
+	}
+
+	if !changes[1].Time.After(changes[0].Time) {
+		t.Errorf("time of second change %s is not after the first %s", changes[1].Time, changes[0].Time)
+	}
+}
+
+func TestAddressChangesAreLimited(t *testing.T) {
+	c := consulResolver{clock: mocks.NewClock()}
+
+	for i := range maxAddressChanges + 5 {
+		c.recordAddressChange([]string{strconv.Itoa(i)}, nil)
+	}
+
+	if len(c.addressChanges) != maxAddressChanges {
+		t.Fatalf("%d address changes are kept, expected %d", len(c.addressChanges), maxAddressChanges)
+	}
+
+	if first := c.addressChanges[0].Added[0]; first != "5" {
+		t.Errorf("oldest kept address change is %s, expected 5", first)
+	}
+}
@@ -0,0 +1,164 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// subsetFilter is the definition of a subset in a service-resolver config
+// entry.
+type subsetFilter struct {
+	filter      string
+	onlyPassing bool
+}
+
+// resolverSubset returns the definition of the subset with the given name from
+// the service-resolver config entry of service.
+// If name is empty, the default subset of the config entry is returned. If the
+// config entry does not define a default subset, a subsetFilter matching all
+// instances is returned.
+func resolverSubset(entry consul.ConfigEntry, service, name string) (*subsetFilter, error) {
+	resolverEntry, ok := entry.(*consul.ServiceResolverConfigEntry)
+	if !ok || resolverEntry == nil {
+		return nil, fmt.Errorf("service-resolver config entry for service '%s' does not exist", service)
+	}
+
+	if name == "" {
+		name = resolverEntry.DefaultSubset
+		if name == "" {
+			return &subsetFilter{}, nil
+		}
+	}
+
+	subset, exists := resolverEntry.Subsets[name]
+	if !exists {
+		return nil, fmt.Errorf("subset '%s' is not defined in the service-resolver config entry of service '%s'", name, service)
+	}
+
+	return &subsetFilter{filter: subset.Filter, onlyPassing: subset.OnlyPassing}, nil
+}
+
+// subsetWatcher monitors the service-resolver config entry of svc and updates
+// the subset definition of svc when it changes.
+func (c *consulResolver) subsetWatcher(svc *serviceWatcher) {
+	defer c.wgStop.Done()
+
+	c.configEntryWatcher(consul.ServiceResolver, svc.name, func(entry consul.ConfigEntry) {
+		svc.setSubset(resolverSubset(entry, svc.name, c.opts.subset))
+	}, func(err error) {
+		svc.subsetQueryFailed(err)
+	})
+}
+
+// setSubset stores the subset definition or the error if the subset can not
+// be resolved. If it differs from the previous one, a running health query is
+// canceled and a new query with the changed subset definition is triggered.
+func (s *serviceWatcher) setSubset(subset *subsetFilter, err error) {
+	s.subsetMutex.Lock()
+	defer s.subsetMutex.Unlock()
+
+	if subsetEqual(s.subset, subset) && errorsEqual(s.subsetErr, err) {
+		return
+	}
+
+	if err != nil {
+		s.log.Warn("resolving subset of service failed", errAttr(err))
+	} else {
+		s.log.Info("subset definition of service changed",
+			"filter", subset.filter,
+			"only_passing", subset.onlyPassing,
+		)
+	}
+
+	s.subset = subset
+	s.subsetErr = err
+	s.subsetGeneration++
+
+	if s.cancelQuery != nil {
+		s.cancelQuery()
+		s.cancelQuery = nil
+	}
+
+	s.triggerResolve()
+}
+
+// subsetQueryFailed is called when retrieving the service-resolver config
+// entry failed. If the subset definition has been retrieved before it is
+// kept, otherwise the error is reported.
+func (s *serviceWatcher) subsetQueryFailed(err error) {
+	s.subsetMutex.Lock()
+	loaded := s.subset != nil
+	s.subsetMutex.Unlock()
+
+	if loaded {
+		return
+	}
+
+	s.setSubset(nil, fmt.Errorf("retrieving service-resolver config entry failed: %w", err))
+}
+
+// subsetQueryOpts returns a copy of opts with the filter of the current subset
+// definition of svc and a context that is canceled when the definition
+// changes. The definition is read and the cancel function is stored in the
+// same critical section, otherwise a change in between would not cancel the
+// query.
+// If the definition changed since the previous query, the WaitIndex of the
+// returned options is 0. Otherwise a change that happens while no query is
+// running would not be applied until the blocking query with the index of
+// the previous subset returns.
+// If the subset has not been retrieved yet or can not be resolved, false is
+// returned. When it can not be resolved, the error is reported.
+func (c *consulResolver) subsetQueryOpts(svc *serviceWatcher, opts *consul.QueryOptions) (*consul.QueryOptions, subsetFilter, bool) {
+	svc.subsetMutex.Lock()
+
+	subset, err := svc.subset, svc.subsetErr
+	if err != nil || subset == nil {
+		svc.subsetMutex.Unlock()
+
+		// If the subset has not been retrieved yet, the watcher
+		// is triggered via resolveNow when it has been.
+		if err != nil {
+			c.reportError(svc, err)
+		}
+
+		return nil, subsetFilter{}, false
+	}
+
+	queryCtx, cancel := context.WithCancel(c.ctx)
+	if svc.cancelQuery != nil {
+		svc.cancelQuery()
+	}
+	svc.cancelQuery = cancel
+
+	changed := svc.queriedSubsetGeneration != svc.subsetGeneration
+	svc.queriedSubsetGeneration = svc.subsetGeneration
+
+	svc.subsetMutex.Unlock()
+
+	result := opts.WithContext(queryCtx)
+	result.Filter = subset.filter
+	if changed {
+		result.WaitIndex = 0
+	}
+
+	return result, *subset, true
+}
+
+func subsetEqual(a, b *subsetFilter) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+func errorsEqual(a, b error) bool {
+	if a == nil || b == nil {
+		return errors.Is(a, b)
+	}
+
+	return a.Error() == b.Error()
+}
@@ -0,0 +1,210 @@
+package consul
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+func TestResolverSubset(t *testing.T) {
+	entry := &consul.ServiceResolverConfigEntry{
+		Kind: consul.ServiceResolver,
+		Name: "user-service",
+		Subsets: map[string]consul.ServiceResolverSubset{
+			"v1": {Filter: `Service.Meta.version == "1"`},
+			"v2": {Filter: `Service.Meta.version == "2"`, OnlyPassing: true},
+		},
+	}
+
+	withDefault := *entry
+	withDefault.DefaultSubset = "v1"
+
+	tests := []struct {
+		name    string
+		entry   consul.ConfigEntry
+		subset  string
+		want    *subsetFilter
+		wantErr bool
+	}{
+		{
+			name:   "namedSubset",
+			entry:  entry,
+			subset: "v2",
+			want:   &subsetFilter{filter: `Service.Meta.version == "2"`, onlyPassing: true},
+		},
+		{
+			name:  "defaultSubset",
+			entry: &withDefault,
+			want:  &subsetFilter{filter: `Service.Meta.version == "1"`},
+		},
+		{
+			name:  "noDefaultSubset",
+			entry: entry,
+			want:  &subsetFilter{},
+		},
+		{
+			name:    "undefinedSubset",
+			entry:   entry,
+			subset:  "v3",
+			wantErr: true,
+		},
+		{
+			name:    "missingEntry",
+			subset:  "v1",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolverSubset(tt.entry, "user-service", tt.subset)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("resolverSubset() succeeded, expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal("resolverSubset() failed:", err)
+			}
+
+			if *got != *tt.want {
+				t.Errorf("resolverSubset() returned %+v, expected: %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSubset(t *testing.T) {
+	responses := map[string][]*consul.ServiceEntry{
+		`Service.Meta.version == "1"`: {
+			{Service: &consul.AgentService{Address: "10.0.0.1", Port: 1}},
+		},
+		`Service.Meta.version == "2"`: {
+			{Service: &consul.AgentService{Address: "10.0.0.2", Port: 1}},
+		},
+	}
+
+	var passingOnlyMu sync.Mutex
+	passingOnlyByFilter := map[string]bool{}
+
+	health := mocks.NewConsulHealthClient()
+	health.ServiceMultipleTagsFn = func(c *mocks.ConsulHealthClient, _ string, _ []string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+		c.Mutex.Lock()
+		c.ResolveCnt++
+		c.Mutex.Unlock()
+
+		passingOnlyMu.Lock()
+		passingOnlyByFilter[q.Filter] = passingOnly
+		passingOnlyMu.Unlock()
+
+		// simulate a blocking query that only returns when it
+		// is canceled
+		if q.WaitIndex != 0 {
+			<-q.Context().Done()
+			return nil, nil, q.Context().Err()
+		}
+
+		return responses[q.Filter], &consul.QueryMeta{LastIndex: 1}, nil
+	}
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	resolverEntry := consul.ServiceResolverConfigEntry{
+		Kind: consul.ServiceResolver,
+		Name: "user-service",
+		Subsets: map[string]consul.ServiceResolverSubset{
+			"stable": {Filter: `Service.Meta.version == "1"`, OnlyPassing: true},
+		},
+		ModifyIndex: 1,
+	}
+
+	configEntries := mocks.NewConsulConfigEntriesClient()
+	configEntries.SetEntries(consul.ServiceResolver, &resolverEntry)
+	t.Cleanup(replaceCreateConfigEntriesClientFn(
+		func(*consul.Config) (consulConfigEntriesEndpoint, error) {
+			return configEntries, nil
+		},
+	))
+
+	cc := mocks.NewClientConn()
+	target := resolver.Target{URL: url.URL{Path: "user-service", RawQuery: "subset=stable&health=fallbackToUnhealthy"}}
+
+	r, err := NewBuilder().Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	waitForAddrs(t, cc, []resolver.Address{{Addr: "10.0.0.1:1"}})
+
+	passingOnlyMu.Lock()
+	if !passingOnlyByFilter[`Service.Meta.version == "1"`] {
+		t.Error("health query was not run with passingOnly for a subset with OnlyPassing")
+	}
+	passingOnlyMu.Unlock()
+
+	t.Run("changedSubsetCancelsRunningQuery", func(t *testing.T) {
+		changed := resolverEntry
+		changed.Subsets = map[string]consul.ServiceResolverSubset{
+			"stable": {Filter: `Service.Meta.version == "2"`},
+		}
+		changed.ModifyIndex = 2
+		configEntries.SetEntries(consul.ServiceResolver, &changed)
+
+		waitForAddrs(t, cc, []resolver.Address{{Addr: "10.0.0.2:1"}})
+
+		passingOnlyMu.Lock()
+		if passingOnlyByFilter[`Service.Meta.version == "2"`] {
+			t.Error("health query was run with passingOnly for a subset without OnlyPassing and health=fallbackToUnhealthy")
+		}
+		passingOnlyMu.Unlock()
+	})
+
+	t.Run("deletedSubsetReportsError", func(t *testing.T) {
+		changed := resolverEntry
+		changed.Subsets = nil
+		changed.ModifyIndex = 3
+		configEntries.SetEntries(consul.ServiceResolver, &changed)
+
+		waitFor(t, func() bool { return cc.ReportErrorCallCnt() > 0 }, "no error was reported after the subset was removed")
+	})
+}
+
+func TestChangedSubsetResetsWaitIndex(t *testing.T) {
+	c := &consulResolver{ctx: context.Background()}
+	svc := &serviceWatcher{log: testLogger, resolveNow: make(chan struct{}, 1)}
+	opts := &consul.QueryOptions{WaitIndex: 5}
+
+	svc.setSubset(&subsetFilter{filter: `Service.Meta.version == "1"`}, nil)
+
+	if q, _, _ := c.subsetQueryOpts(svc, opts); q.WaitIndex != 0 {
+		t.Errorf("first query has WaitIndex %d, expected 0", q.WaitIndex)
+	}
+
+	if q, _, _ := c.subsetQueryOpts(svc, opts); q.WaitIndex != 5 {
+		t.Errorf("query with unchanged subset has WaitIndex %d, expected 5", q.WaitIndex)
+	}
+
+	// the subset changes while no query is running
+	svc.setSubset(&subsetFilter{filter: `Service.Meta.version == "2"`}, nil)
+
+	q, subset, ok := c.subsetQueryOpts(svc, opts)
+	if !ok || subset.filter != `Service.Meta.version == "2"` {
+		t.Fatalf("subsetQueryOpts() returned subset %+v, ok %t, expected the changed subset", subset, ok)
+	}
+
+	if q.WaitIndex != 0 {
+		t.Errorf("query after the subset changed has WaitIndex %d, expected 0", q.WaitIndex)
+	}
+}
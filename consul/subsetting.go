@@ -0,0 +1,86 @@
+package consul
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	"os"
+	"slices"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// defaultClientID returns the ID that is used for deterministic subsetting
+// when none was passed to the builder.
+// It is the hostname, if it can not be retrieved a random ID is returned.
+func defaultClientID() string {
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+
+	return hex.EncodeToString(id[:])
+}
+
+// rendezvousWeight returns the weight of the endpoint with the key for the
+// client with clientID.
+func rendezvousWeight(clientID, key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(clientID))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(key))
+
+	// FNV does not distribute similar inputs well over the whole value
+	// range, the splitmix64 finalizer mixes the bits
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
+
+// subsetEndpoints returns a subset of size endpoints, selected via rendezvous
+// hashing for the client with clientID.
+// Each client selects the endpoints with the highest weights for its ID.
+// Different clients select different subsets that are evenly distributed
+// over all endpoints. When an endpoint is added or removed, at most one
+// endpoint of a subset changes.
+// The endpoints are identified by their first address. The order of
+// endpoints is preserved.
+func subsetEndpoints(endpoints []resolver.Endpoint, clientID string, size int) []resolver.Endpoint {
+	if len(endpoints) <= size {
+		return endpoints
+	}
+
+	type weighted struct {
+		idx    int
+		weight uint64
+	}
+
+	weights := make([]weighted, 0, len(endpoints))
+	for i, e := range endpoints {
+		weights = append(weights, weighted{idx: i, weight: rendezvousWeight(clientID, e.Addresses[0].Addr)})
+	}
+
+	slices.SortFunc(weights, func(a, b weighted) int {
+		return cmp.Compare(b.weight, a.weight)
+	})
+
+	selected := weights[:size]
+	slices.SortFunc(selected, func(a, b weighted) int {
+		return cmp.Compare(a.idx, b.idx)
+	})
+
+	result := make([]resolver.Endpoint, 0, size)
+	for _, w := range selected {
+		result = append(result, endpoints[w.idx])
+	}
+
+	return result
+}
@@ -0,0 +1,151 @@
+package consul
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+func testEndpoints(n int) []resolver.Endpoint {
+	result := make([]resolver.Endpoint, 0, n)
+	for i := range n {
+		result = append(result, resolver.Endpoint{
+			Addresses: []resolver.Address{{Addr: fmt.Sprintf("10.0.%d.%d:8080", i/256, i%256)}},
+		})
+	}
+
+	return result
+}
+
+func TestSubsetEndpointsIsBalanced(t *testing.T) {
+	const clients = 1000
+	const backends = 100
+	const subsetSize = 10
+
+	endpoints := testEndpoints(backends)
+	conns := map[string]int{}
+
+	for i := range clients {
+		subset := subsetEndpoints(endpoints, fmt.Sprintf("client-%d", i), subsetSize)
+		if len(subset) != subsetSize {
+			t.Fatalf("subset has %d endpoints, expected %d", len(subset), subsetSize)
+		}
+
+		for _, e := range subset {
+			conns[e.Addresses[0].Addr]++
+		}
+	}
+
+	// Each backend is expected to be selected by 100 clients. The number
+	// is binomially distributed with a standard deviation of ~9.5, the
+	// bounds are more than 4 standard deviations away from the mean.
+	const want = clients * subsetSize / backends
+	for _, e := range endpoints {
+		addr := e.Addresses[0].Addr
+		if conns[addr] < want-40 || conns[addr] > want+40 {
+			t.Errorf("backend %s was selected by %d clients, expected ~%d", addr, conns[addr], want)
+		}
+	}
+}
+
+func TestSubsetEndpointsMinimalChurn(t *testing.T) {
+	const subsetSize = 10
+
+	endpoints := testEndpoints(100)
+	removed := slices.Delete(slices.Clone(endpoints), 42, 43)
+	added := append(testEndpoints(101)[100:], endpoints...)
+
+	for i := range 100 {
+		clientID := fmt.Sprintf("client-%d", i)
+		subset := subsetEndpoints(endpoints, clientID, subsetSize)
+
+		if diff := subsetDiff(subset, subsetEndpoints(removed, clientID, subsetSize)); diff > 1 {
+			t.Errorf("removing an endpoint changed %d endpoints of the subset of %s, expected at most 1", diff, clientID)
+		}
+
+		if diff := subsetDiff(subset, subsetEndpoints(added, clientID, subsetSize)); diff > 1 {
+			t.Errorf("adding an endpoint changed %d endpoints of the subset of %s, expected at most 1", diff, clientID)
+		}
+
+		if diff := subsetDiff(subset, subsetEndpoints(endpoints, clientID, subsetSize)); diff != 0 {
+			t.Errorf("subset of %s is not deterministic", clientID)
+		}
+	}
+}
+
+func TestSubsetEndpointsSmallerThanSize(t *testing.T) {
+	endpoints := testEndpoints(3)
+
+	if subset := subsetEndpoints(endpoints, "client", 5); len(subset) != 3 {
+		t.Errorf("subset has %d endpoints, expected 3", len(subset))
+	}
+}
+
+func TestResolveSubsetSize(t *testing.T) {
+	entries := make([]*consul.ServiceEntry, 0, 20)
+	for i := range 20 {
+		entries = append(entries, &consul.ServiceEntry{
+			Service: &consul.AgentService{Address: fmt.Sprintf("10.0.0.%d", i), Port: 1},
+		})
+	}
+
+	health := mocks.NewConsulHealthClient()
+	health.SetRespEntries(entries)
+	t.Cleanup(replaceCreateHealthClientFn(
+		func(*consul.Config) (consulHealthEndpoint, error) {
+			return health, nil
+		},
+	))
+
+	target := resolver.Target{URL: url.URL{Path: "user-service", RawQuery: "subsetSize=5"}}
+
+	resolve := func(clientID string) []resolver.Address {
+		cc := mocks.NewClientConn()
+
+		r, err := NewBuilder(WithClientID(clientID)).Build(target, cc, resolver.BuildOptions{})
+		if err != nil {
+			t.Fatal("Build() failed:", err.Error())
+		}
+		defer r.Close()
+
+		waitFor(t, func() bool { return cc.UpdateStateCallCnt() > 0 }, "UpdateState was not called")
+
+		if len(cc.Endpoints()) != 5 {
+			t.Errorf("resolved %d endpoints, expected 5", len(cc.Endpoints()))
+		}
+
+		return cc.Addrs()
+	}
+
+	addrs := resolve("client-1")
+	if len(addrs) != 5 {
+		t.Errorf("resolved %d addresses, expected 5", len(addrs))
+	}
+
+	if !cmpAddrs(addrs, resolve("client-1")) {
+		t.Error("resolving with the same client ID returned different subsets")
+	}
+}
+
+// subsetDiff returns the number of endpoints in a that are not in b.
+func subsetDiff(a, b []resolver.Endpoint) int {
+	inB := map[string]bool{}
+	for _, e := range b {
+		inB[e.Addresses[0].Addr] = true
+	}
+
+	var result int
+	for _, e := range a {
+		if !inB[e.Addresses[0].Addr] {
+			result++
+		}
+	}
+
+	return result
+}
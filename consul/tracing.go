@@ -0,0 +1,93 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	consul "github.com/hashicorp/consul/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/simplesurance/grpcconsulresolver/consul"
+
+// tracer returns the tracer of tp, if tp is nil a tracer that records no
+// spans is returned.
+func tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
+
+	return tp.Tracer(tracerName)
+}
+
+// startQuerySpan starts the span for a query of the instances of service.
+// The returned context contains the span, it must be passed to the query.
+func (c *consulResolver) startQuerySpan(ctx context.Context, service string, passingOnly bool, waitIndex uint64) (context.Context, trace.Span) {
+	return c.tracer.Start(ctx, "consul.health.service",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("consul.service", service),
+			attribute.StringSlice("consul.tags", c.opts.tags),
+			attribute.String("consul.datacenter", c.opts.datacenter),
+			attribute.Bool("consul.passing_only", passingOnly),
+			attribute.Int64("consul.wait_index", int64(waitIndex)),
+		),
+	)
+}
+
+// recordQueryResult records the result of a query in span.
+func recordQueryResult(span trace.Span, resultCnt int, index uint64, err error) {
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int("consul.result_count", resultCnt),
+		attribute.Int64("consul.index", int64(index)),
+	)
+}
+
+// tracingTransport is a [http.RoundTripper] that injects the trace context of
+// the request context into the request headers.
+type tracingTransport struct {
+	base       http.RoundTripper
+	propagator propagation.TextMapPropagator
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrip must not modify the passed request
+	req = req.Clone(req.Context())
+	t.propagator.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+
+	return t.base.RoundTrip(req)
+}
+
+// newTracingHTTPClient returns an HTTP client for the Consul API that
+// propagates the trace context in W3C Trace Context headers.
+// It is configured like the client that [consul.NewClient] creates when
+// none is passed.
+func newTracingHTTPClient() (*http.Client, error) {
+	defCfg := consul.DefaultConfig()
+
+	clt, err := consul.NewHttpClient(defCfg.Transport, defCfg.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	clt.Transport = &tracingTransport{
+		base:       clt.Transport,
+		propagator: propagation.TraceContext{},
+	}
+
+	return clt, nil
+}
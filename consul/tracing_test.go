@@ -0,0 +1,86 @@
+package consul
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/mocks"
+)
+
+func TestQuerySpansAreRecorded(t *testing.T) {
+	var mutex sync.Mutex
+	var traceparents []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Consul-Index", "42")
+		_, _ = w.Write([]byte(`[{"Service": {"Address": "10.0.0.1", "Port": 1}}]`))
+	}))
+	t.Cleanup(srv.Close)
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	cc := mocks.NewClientConn()
+	target := resolver.Target{URL: url.URL{
+		Host:     srv.Listener.Addr().String(),
+		Path:     "user-service",
+		RawQuery: "tags=primary",
+	}}
+
+	r, err := NewBuilder(WithTracerProvider(tp)).Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal("Build() failed:", err.Error())
+	}
+	t.Cleanup(r.Close)
+
+	waitForAddrs(t, cc, []resolver.Address{{Addr: "10.0.0.1:1"}})
+
+	var spans []sdktrace.ReadOnlySpan
+	waitFor(t, func() bool {
+		spans = recorder.Ended()
+		return len(spans) > 0
+	}, "no span was recorded")
+
+	span := spans[0]
+	if span.Name() != "consul.health.service" {
+		t.Errorf("span name is %q, expected consul.health.service", span.Name())
+	}
+
+	attrs := attribute.NewSet(span.Attributes()...)
+	for k, want := range map[attribute.Key]attribute.Value{
+		"consul.service":      attribute.StringValue("user-service"),
+		"consul.tags":         attribute.StringSliceValue([]string{"primary"}),
+		"consul.result_count": attribute.IntValue(1),
+		"consul.index":        attribute.Int64Value(42),
+	} {
+		if v, _ := attrs.Value(k); v.Emit() != want.Emit() {
+			t.Errorf("span attribute %s is %q, expected %q", k, v.Emit(), want.Emit())
+		}
+	}
+
+	if events := span.Events(); len(events) != 1 || events[0].Name != "addresses reported" {
+		t.Errorf("span has events %+v, expected one addresses reported event", events)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	wantTraceparent := "00-" + span.SpanContext().TraceID().String() + "-" + span.SpanContext().SpanID().String() + "-01"
+	if !slices.Contains(traceparents, wantTraceparent) {
+		t.Errorf("consul requests have traceparent headers %q, expected one with %q", traceparents, wantTraceparent)
+	}
+}
@@ -0,0 +1,125 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sync"
+
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// WaitForResolution builds a resolver for target and blocks until it
+// resolved at least one address, which is returned. It can be used to delay
+// the readiness of an application until its dependencies can be resolved.
+// target is a URL in the format that is described in the package
+// documentation, the resolver is configured via opts.
+//
+// If ctx is done before an address is resolved, its error is returned,
+// wrapping the last error reported by the resolver, if there is one. When
+// the initialResolveTimeout OPT is set in target and expires, the error that
+// wraps [ErrInitialResolveTimeout] is returned immediately.
+//
+// The cache that is enabled via [WithCacheDir] is not used, only addresses
+// that were retrieved from Consul satisfy the wait.
+func WaitForResolution(ctx context.Context, target string, opts ...Option) ([]resolver.Address, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("parsing target failed: %w", err)
+	}
+
+	cc := newWaitClientConn()
+
+	b := NewBuilder(opts...)
+	b.cacheDir = ""
+
+	r, err := b.Build(resolver.Target{URL: *u}, cc, resolver.BuildOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	select {
+	case addrs := <-cc.resolved:
+		return addrs, nil
+
+	case err := <-cc.timedOut:
+		return nil, err
+
+	case <-ctx.Done():
+		if err := cc.lastError(); err != nil {
+			return nil, fmt.Errorf("%w: %w", ctx.Err(), err)
+		}
+
+		return nil, ctx.Err()
+	}
+}
+
+// waitClientConn is the [resolver.ClientConn] that is used by
+// [WaitForResolution].
+type waitClientConn struct {
+	// resolved receives the first non-empty addresses, timedOut the
+	// first error that wraps [ErrInitialResolveTimeout].
+	resolved chan []resolver.Address
+	timedOut chan error
+
+	mutex   sync.Mutex
+	lastErr error
+}
+
+func newWaitClientConn() *waitClientConn {
+	return &waitClientConn{
+		resolved: make(chan []resolver.Address, 1),
+		timedOut: make(chan error, 1),
+	}
+}
+
+func (cc *waitClientConn) UpdateState(s resolver.State) error {
+	cc.mutex.Lock()
+	cc.lastErr = nil
+	cc.mutex.Unlock()
+
+	if len(s.Addresses) == 0 {
+		return nil
+	}
+
+	select {
+	case cc.resolved <- slices.Clone(s.Addresses):
+	default:
+	}
+
+	return nil
+}
+
+func (cc *waitClientConn) ReportError(err error) {
+	cc.mutex.Lock()
+	cc.lastErr = err
+	cc.mutex.Unlock()
+
+	if !errors.Is(err, ErrInitialResolveTimeout) {
+		return
+	}
+
+	select {
+	case cc.timedOut <- err:
+	default:
+	}
+}
+
+func (cc *waitClientConn) lastError() error {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	return cc.lastErr
+}
+
+func (*waitClientConn) NewAddress([]resolver.Address) {}
+
+// ParseServiceConfig returns an empty result, the service config is not used
+// by [WaitForResolution].
+func (*waitClientConn) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return &serviceconfig.ParseResult{}
+}
@@ -0,0 +1,42 @@
+// Package clock provides an abstraction of the time functions that are used
+// by the resolver, to be able to control the passing of time in tests.
+package clock
+
+import "time"
+
+// Clock provides the current time and timers.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	// After waits for the duration to elapse and then sends the current
+	// time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+	// AfterFunc waits for the duration to elapse and then calls f.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created via [Clock.AfterFunc].
+type Timer interface {
+	// Stop prevents the timer from firing. It returns false if the timer
+	// already expired or has been stopped.
+	Stop() bool
+}
+
+// Real is a [Clock] that uses the functions of the time package.
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (Real) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
@@ -1,6 +1,7 @@
 package mocks
 
 import (
+	"encoding/json"
 	"errors"
 	"sync"
 
@@ -11,6 +12,9 @@ import (
 type ClientConn struct {
 	mutex              sync.Mutex
 	addrs              []resolver.Address
+	endpoints          []resolver.Endpoint
+	state              resolver.State
+	serviceConfig      *serviceconfig.ParseResult
 	newAddressCallCnt  int
 	reportErrorCallcnt int
 	lastReportedError  error
@@ -20,8 +24,21 @@ func NewClientConn() *ClientConn {
 	return &ClientConn{}
 }
 
-func (t *ClientConn) ParseServiceConfig(_ string) *serviceconfig.ParseResult {
-	return &serviceconfig.ParseResult{Err: errors.New("config parsing not implemented in test mock")}
+// ServiceConfig is the [serviceconfig.Config] returned by
+// [ClientConn.ParseServiceConfig].
+type ServiceConfig struct {
+	serviceconfig.Config
+	JSON string
+}
+
+// ParseServiceConfig returns a [ServiceConfig] if js is valid JSON.
+// The content of the service config is not validated.
+func (t *ClientConn) ParseServiceConfig(js string) *serviceconfig.ParseResult {
+	if !json.Valid([]byte(js)) {
+		return &serviceconfig.ParseResult{Err: errors.New("service config is not valid JSON")}
+	}
+
+	return &serviceconfig.ParseResult{Config: &ServiceConfig{JSON: js}}
 }
 
 func (t *ClientConn) ReportError(err error) {
@@ -51,6 +68,9 @@ func (t *ClientConn) UpdateState(state resolver.State) error {
 	defer t.mutex.Unlock()
 
 	t.addrs = state.Addresses
+	t.endpoints = state.Endpoints
+	t.state = state
+	t.serviceConfig = state.ServiceConfig
 	t.newAddressCallCnt++
 
 	return nil
@@ -78,5 +98,34 @@ func (t *ClientConn) Addrs() (addrs []resolver.Address) {
 	return t.addrs
 }
 
+func (t *ClientConn) Endpoints() []resolver.Endpoint {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.endpoints
+}
+
+// State returns the state that was passed to the last UpdateState call.
+func (t *ClientConn) State() resolver.State {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.state
+}
+
+// ServiceConfigJSON returns the JSON of the service config that was passed to
+// the last UpdateState call. If it was called without a service config, an
+// empty string is returned.
+func (t *ClientConn) ServiceConfigJSON() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.serviceConfig == nil {
+		return ""
+	}
+
+	return t.serviceConfig.Config.(*ServiceConfig).JSON
+}
+
 func (*ClientConn) NewServiceConfig(string) {
 }
@@ -0,0 +1,134 @@
+package mocks
+
+import (
+	"sync"
+	"time"
+
+	"github.com/simplesurance/grpcconsulresolver/internal/clock"
+)
+
+// Clock is a [clock.Clock] whose time only passes when [Clock.Advance] is
+// called.
+type Clock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*clockTimer
+	// timersChanged is closed and replaced when a timer is added.
+	timersChanged chan struct{}
+}
+
+type clockTimer struct {
+	clock    *Clock
+	deadline time.Time
+	f        func()
+	ch       chan time.Time
+}
+
+func NewClock() *Clock {
+	return &Clock{
+		now:           time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		timersChanged: make(chan struct{}),
+	}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *Clock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.addTimer(&clockTimer{clock: c, deadline: c.Now().Add(d), ch: ch})
+
+	return ch
+}
+
+func (c *Clock) AfterFunc(d time.Duration, f func()) clock.Timer {
+	t := &clockTimer{clock: c, deadline: c.Now().Add(d), f: f}
+	c.addTimer(t)
+
+	return t
+}
+
+func (c *Clock) addTimer(t *clockTimer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.timers = append(c.timers, t)
+
+	close(c.timersChanged)
+	c.timersChanged = make(chan struct{})
+}
+
+// Advance moves the time forward by d and fires the timers that expired.
+// The functions of timers created via AfterFunc are run synchronously.
+func (c *Clock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+
+	var expired []*clockTimer
+	remaining := c.timers[:0]
+	for _, t := range c.timers {
+		if t.deadline.After(now) {
+			remaining = append(remaining, t)
+			continue
+		}
+
+		expired = append(expired, t)
+	}
+	c.timers = remaining
+	c.mutex.Unlock()
+
+	for _, t := range expired {
+		if t.f != nil {
+			t.f()
+			continue
+		}
+
+		t.ch <- now
+	}
+}
+
+// TimerCount returns the number of timers that did not fire yet.
+func (c *Clock) TimerCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.timers)
+}
+
+// WaitForTimers blocks until at least n timers are pending.
+func (c *Clock) WaitForTimers(n int) {
+	for {
+		c.mutex.Lock()
+		if len(c.timers) >= n {
+			c.mutex.Unlock()
+			return
+		}
+		ch := c.timersChanged
+		c.mutex.Unlock()
+
+		<-ch
+	}
+}
+
+func (t *clockTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	for i, t1 := range t.clock.timers {
+		if t1 == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,63 @@
+package mocks
+
+import (
+	"sync"
+)
+
+type ConsulAgentClient struct {
+	mutex      sync.Mutex
+	datacenter string
+	nodeMeta   map[string]string
+	err        error
+	selfCnt    int
+}
+
+func NewConsulAgentClient(datacenter string) *ConsulAgentClient {
+	return &ConsulAgentClient{datacenter: datacenter}
+}
+
+func (c *ConsulAgentClient) SetRespError(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.err = err
+}
+
+// SetNodeMeta sets the node metadata that is returned in the Meta field of
+// the Self response.
+func (c *ConsulAgentClient) SetNodeMeta(meta map[string]string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.nodeMeta = meta
+}
+
+func (c *ConsulAgentClient) Self() (map[string]map[string]interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.selfCnt++
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	meta := make(map[string]interface{}, len(c.nodeMeta))
+	for k, v := range c.nodeMeta {
+		meta[k] = v
+	}
+
+	return map[string]map[string]interface{}{
+		"Config": {
+			"Datacenter": c.datacenter,
+		},
+		"Meta": meta,
+	}, nil
+}
+
+func (c *ConsulAgentClient) SelfCallCnt() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.selfCnt
+}
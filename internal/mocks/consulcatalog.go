@@ -0,0 +1,68 @@
+package mocks
+
+import (
+	"slices"
+	"sync"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+type ConsulCatalogClient struct {
+	mutex      sync.Mutex
+	services   map[string][]*consul.CatalogService
+	err        error
+	serviceCnt int
+}
+
+func NewConsulCatalogClient() *ConsulCatalogClient {
+	return &ConsulCatalogClient{services: map[string][]*consul.CatalogService{}}
+}
+
+// SetServiceInstances sets the registered instances of service.
+func (c *ConsulCatalogClient) SetServiceInstances(service string, instances []*consul.CatalogService) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.services[service] = instances
+}
+
+func (c *ConsulCatalogClient) SetRespError(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.err = err
+}
+
+// Service returns the instances of service that have the tag, if tag is not
+// empty.
+func (c *ConsulCatalogClient) Service(service, tag string, q *consul.QueryOptions) ([]*consul.CatalogService, *consul.QueryMeta, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.serviceCnt++
+
+	if q.Context().Err() != nil {
+		return nil, nil, q.Context().Err()
+	}
+
+	if c.err != nil {
+		return nil, nil, c.err
+	}
+
+	var result []*consul.CatalogService
+	for _, s := range c.services[service] {
+		if tag == "" || slices.Contains(s.ServiceTags, tag) {
+			result = append(result, s)
+		}
+	}
+
+	return result, &consul.QueryMeta{}, nil
+}
+
+// ServiceCallCnt returns how often Service was called.
+func (c *ConsulCatalogClient) ServiceCallCnt() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.serviceCnt
+}
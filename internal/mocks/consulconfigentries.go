@@ -0,0 +1,63 @@
+package mocks
+
+import (
+	"sync"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+type ConsulConfigEntriesClient struct {
+	mutex   sync.Mutex
+	entries map[string][]consul.ConfigEntry
+	index   uint64
+	err     error
+	listCnt int
+}
+
+func NewConsulConfigEntriesClient() *ConsulConfigEntriesClient {
+	return &ConsulConfigEntriesClient{
+		entries: map[string][]consul.ConfigEntry{},
+		index:   1,
+	}
+}
+
+// SetEntries sets the config entries that are returned for kind.
+// The ModifyIndex of the entries must be set by the caller.
+func (c *ConsulConfigEntriesClient) SetEntries(kind string, entries ...consul.ConfigEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries[kind] = entries
+	c.index++
+}
+
+func (c *ConsulConfigEntriesClient) SetRespError(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.err = err
+}
+
+func (c *ConsulConfigEntriesClient) List(kind string, q *consul.QueryOptions) ([]consul.ConfigEntry, *consul.QueryMeta, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.listCnt++
+
+	if q.Context().Err() != nil {
+		return nil, nil, q.Context().Err()
+	}
+
+	if c.err != nil {
+		return nil, nil, c.err
+	}
+
+	return c.entries[kind], &consul.QueryMeta{LastIndex: c.index}, nil
+}
+
+func (c *ConsulConfigEntriesClient) ListCallCnt() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.listCnt
+}
@@ -45,9 +45,9 @@ func (c *ConsulHealthClient) SetRespError(err error) {
 	c.Err = err
 }
 
-func (c *ConsulHealthClient) ServiceMultipleTags(_ string, _ []string, _ bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+func (c *ConsulHealthClient) ServiceMultipleTags(service string, tags []string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
 	if c.ServiceMultipleTagsFn != nil {
-		return c.ServiceMultipleTagsFn(c, "", nil, false, q)
+		return c.ServiceMultipleTagsFn(c, service, tags, passingOnly, q)
 	}
 
 	c.Mutex.Lock()
@@ -0,0 +1,71 @@
+package mocks
+
+import (
+	"sync"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+type ConsulKVClient struct {
+	mutex  sync.Mutex
+	values map[string][]byte
+	index  uint64
+	err    error
+	getCnt int
+}
+
+func NewConsulKVClient() *ConsulKVClient {
+	return &ConsulKVClient{values: map[string][]byte{}, index: 1}
+}
+
+// SetValue sets the value of key. If value is nil, key is deleted.
+func (c *ConsulKVClient) SetValue(key string, value []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if value == nil {
+		delete(c.values, key)
+	} else {
+		c.values[key] = value
+	}
+
+	c.index++
+}
+
+func (c *ConsulKVClient) SetRespError(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.err = err
+}
+
+func (c *ConsulKVClient) Get(key string, q *consul.QueryOptions) (*consul.KVPair, *consul.QueryMeta, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.getCnt++
+
+	if q.Context().Err() != nil {
+		return nil, nil, q.Context().Err()
+	}
+
+	if c.err != nil {
+		return nil, nil, c.err
+	}
+
+	meta := consul.QueryMeta{LastIndex: c.index}
+
+	val, exists := c.values[key]
+	if !exists {
+		return nil, &meta, nil
+	}
+
+	return &consul.KVPair{Key: key, Value: val, ModifyIndex: c.index}, &meta, nil
+}
+
+func (c *ConsulKVClient) GetCallCnt() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.getCnt
+}
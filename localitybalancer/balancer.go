@@ -0,0 +1,98 @@
+// Package localitybalancer implements a gRPC load balancer that prefers
+// backends in the locality of the client.
+//
+// The balancer requires that the locality of the backends and of the client
+// are provided by the resolver, the consul resolver does it when the
+// regionMeta or zoneMeta OPT is set.
+//
+// Requests are balanced round-robin over the ready backends that are in the
+// zone of the client. If the client has no zone, the backends in its region
+// are preferred. When the fraction of the ready backends in the locality of
+// the client falls below the localCapacityThreshold, requests are balanced
+// over all ready backends.
+//
+// To register the balancer with the grpc-go library run:
+//
+//	balancer.Register(localitybalancer.NewBuilder())
+//
+// Afterwards it can be enabled via the service config:
+//
+//	{"loadBalancingConfig": [{"consul_locality": {"localCapacityThreshold": 0.5}}]}
+//
+// The default localCapacityThreshold is 0.5.
+package localitybalancer
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Name is the name of the balancer.
+const Name = "consul_locality"
+
+const defaultLocalCapacityThreshold = 0.5
+
+var logger = grpclog.Component("grpcconsulresolver")
+
+type lbConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	LocalCapacityThreshold *float64 `json:"localCapacityThreshold,omitempty"`
+}
+
+type builder struct{}
+
+// NewBuilder returns a builder for the locality-aware balancer.
+func NewBuilder() balancer.Builder {
+	return &builder{}
+}
+
+func (*builder) Name() string {
+	return Name
+}
+
+func (*builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &pickerBuilder{localCapacityThreshold: defaultLocalCapacityThreshold}
+
+	return &localityBalancer{
+		Balancer:      base.NewBalancerBuilder(Name, pb, base.Config{HealthCheck: true}).Build(cc, opts),
+		pickerBuilder: pb,
+	}
+}
+
+func (*builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	var cfg lbConfig
+
+	if err := json.Unmarshal(js, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s balancer config failed: %w", Name, err)
+	}
+
+	if t := cfg.LocalCapacityThreshold; t != nil && (*t < 0 || *t > 1) {
+		return nil, fmt.Errorf("localCapacityThreshold must be between 0 and 1, got: %v", *t)
+	}
+
+	return &cfg, nil
+}
+
+// localityBalancer is a base balancer that passes the resolver state and
+// config to its picker builder.
+type localityBalancer struct {
+	balancer.Balancer
+	pickerBuilder *pickerBuilder
+}
+
+func (b *localityBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	threshold := defaultLocalCapacityThreshold
+	if cfg, ok := s.BalancerConfig.(*lbConfig); ok && cfg.LocalCapacityThreshold != nil {
+		threshold = *cfg.LocalCapacityThreshold
+	}
+
+	b.pickerBuilder.update(s.ResolverState, threshold)
+
+	return b.Balancer.UpdateClientConnState(s)
+}
@@ -0,0 +1,114 @@
+package localitybalancer
+
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/consul"
+)
+
+// pickerBuilder creates pickers that prefer the ready SubConns in the
+// locality of the client.
+type pickerBuilder struct {
+	// mutex protects the fields, they are updated by the balancer when
+	// the resolver state changes.
+	mutex                  sync.Mutex
+	clientLocality         consul.Locality
+	localCapacityThreshold float64
+	// localAddrCnt is the number of resolved addresses in the locality
+	// of the client.
+	localAddrCnt int
+}
+
+func (pb *pickerBuilder) update(state resolver.State, localCapacityThreshold float64) {
+	clientLocality, _ := consul.LocalityFromState(state)
+
+	var localAddrCnt int
+	for _, addr := range state.Addresses {
+		if l, ok := consul.LocalityFromAddress(addr); ok && isLocal(clientLocality, l) {
+			localAddrCnt++
+		}
+	}
+
+	pb.mutex.Lock()
+	defer pb.mutex.Unlock()
+
+	pb.clientLocality = clientLocality
+	pb.localCapacityThreshold = localCapacityThreshold
+	pb.localAddrCnt = localAddrCnt
+}
+
+func (pb *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	pb.mutex.Lock()
+	defer pb.mutex.Unlock()
+
+	all := make([]balancer.SubConn, 0, len(info.ReadySCs))
+	var local []balancer.SubConn
+
+	for sc, sci := range info.ReadySCs {
+		all = append(all, sc)
+
+		if l, ok := consul.LocalityFromAddress(sci.Address); ok && isLocal(pb.clientLocality, l) {
+			local = append(local, sc)
+		}
+	}
+
+	if len(local) == 0 || pb.localAddrCnt == 0 {
+		return newPicker(all)
+	}
+
+	if float64(len(local))/float64(pb.localAddrCnt) < pb.localCapacityThreshold {
+		if logger.V(2) {
+			logger.Infof("%d of %d backends in locality %+v are ready, spilling over to other localities",
+				len(local), pb.localAddrCnt, pb.clientLocality)
+		}
+
+		return newPicker(all)
+	}
+
+	return newPicker(local)
+}
+
+// isLocal returns true if l is in the locality of the client.
+// If the client has a zone, the zones and regions must match, otherwise only
+// the regions.
+func isLocal(client, l consul.Locality) bool {
+	if client.IsZero() {
+		return false
+	}
+
+	if client.Zone != "" && client.Zone != l.Zone {
+		return false
+	}
+
+	return client.Region == "" || client.Region == l.Region
+}
+
+// picker picks the SubConns round-robin.
+type picker struct {
+	subConns []balancer.SubConn
+	next     atomic.Uint32
+}
+
+func newPicker(subConns []balancer.SubConn) *picker {
+	p := picker{subConns: subConns}
+	// start at a random index, to prevent that all clients send their
+	// first requests to the same backend
+	p.next.Store(rand.Uint32())
+
+	return &p
+}
+
+func (p *picker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	idx := p.next.Add(1)
+	return balancer.PickResult{SubConn: p.subConns[idx%uint32(len(p.subConns))]}, nil
+}
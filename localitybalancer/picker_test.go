@@ -0,0 +1,158 @@
+package localitybalancer
+
+import (
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/simplesurance/grpcconsulresolver/consul"
+)
+
+type testSubConn struct {
+	balancer.SubConn
+	addr string
+}
+
+// testState returns a resolver state with one address in each of the zones
+// and a PickerBuildInfo where the addresses with the indexes in ready are
+// ready.
+func testState(client consul.Locality, zones []string, ready ...int) (resolver.State, base.PickerBuildInfo) {
+	var state resolver.State
+	if !client.IsZero() {
+		state.Attributes = consul.LocalityAttributes(client)
+	}
+
+	for i, zone := range zones {
+		state.Addresses = append(state.Addresses, resolver.Address{
+			Addr:               fmt.Sprintf("10.0.0.%d:1", i),
+			BalancerAttributes: consul.LocalityAttributes(consul.Locality{Region: "eu", Zone: zone}),
+		})
+	}
+
+	info := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{}}
+	for _, i := range ready {
+		addr := state.Addresses[i]
+		info.ReadySCs[&testSubConn{addr: addr.Addr}] = base.SubConnInfo{Address: addr}
+	}
+
+	return state, info
+}
+
+func pickedAddrs(t *testing.T, p balancer.Picker, picks int) map[string]int {
+	t.Helper()
+
+	result := map[string]int{}
+	for range picks {
+		res, err := p.Pick(balancer.PickInfo{})
+		if err != nil {
+			t.Fatal("Pick() failed:", err)
+		}
+
+		result[res.SubConn.(*testSubConn).addr]++
+	}
+
+	return result
+}
+
+func TestPickerPrefersLocalZone(t *testing.T) {
+	client := consul.Locality{Region: "eu", Zone: "a"}
+	zones := []string{"a", "a", "b", "b"}
+
+	tests := []struct {
+		name      string
+		client    consul.Locality
+		ready     []int
+		threshold float64
+		want      []string
+	}{
+		{
+			name:      "allLocalReady",
+			client:    client,
+			ready:     []int{0, 1, 2, 3},
+			threshold: 0.5,
+			want:      []string{"10.0.0.0:1", "10.0.0.1:1"},
+		},
+		{
+			name:      "localCapacityAtThreshold",
+			client:    client,
+			ready:     []int{1, 2, 3},
+			threshold: 0.5,
+			want:      []string{"10.0.0.1:1"},
+		},
+		{
+			name:      "localCapacityBelowThreshold",
+			client:    client,
+			ready:     []int{1, 2, 3},
+			threshold: 0.75,
+			want:      []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1"},
+		},
+		{
+			name:      "noLocalReady",
+			client:    client,
+			ready:     []int{2, 3},
+			threshold: 0,
+			want:      []string{"10.0.0.2:1", "10.0.0.3:1"},
+		},
+		{
+			name:      "noClientLocality",
+			ready:     []int{0, 2},
+			threshold: 0.5,
+			want:      []string{"10.0.0.0:1", "10.0.0.2:1"},
+		},
+		{
+			name:      "clientRegionOnly",
+			client:    consul.Locality{Region: "eu"},
+			ready:     []int{0, 3},
+			threshold: 0.5,
+			want:      []string{"10.0.0.0:1", "10.0.0.3:1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, info := testState(tt.client, zones, tt.ready...)
+
+			pb := pickerBuilder{}
+			pb.update(state, tt.threshold)
+
+			picked := pickedAddrs(t, pb.Build(info), 100)
+
+			if len(picked) != len(tt.want) {
+				t.Errorf("picked addresses %v, expected: %v", picked, tt.want)
+			}
+
+			for _, addr := range tt.want {
+				if picked[addr] == 0 {
+					t.Errorf("address %s was not picked, picked: %v", addr, picked)
+				}
+			}
+		})
+	}
+}
+
+func TestPickerWithoutReadySubConnsFails(t *testing.T) {
+	pb := pickerBuilder{}
+
+	_, err := pb.Build(base.PickerBuildInfo{}).Pick(balancer.PickInfo{})
+	if err == nil {
+		t.Error("Pick() succeeded, expected an error")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	if _, err := NewBuilder().(balancer.ConfigParser).ParseConfig([]byte(`{"localCapacityThreshold": 1.5}`)); err == nil {
+		t.Error("ParseConfig() succeeded for a threshold > 1, expected an error")
+	}
+
+	cfg, err := NewBuilder().(balancer.ConfigParser).ParseConfig([]byte(`{"localCapacityThreshold": 0.25}`))
+	if err != nil {
+		t.Fatal("ParseConfig() failed:", err)
+	}
+
+	if got := *cfg.(*lbConfig).LocalCapacityThreshold; got != 0.25 {
+		t.Errorf("localCapacityThreshold is %v, expected 0.25", got)
+	}
+}
@@ -0,0 +1,163 @@
+// Package otelmetrics records metrics about the activity of consul resolvers
+// via OpenTelemetry.
+//
+// To record metrics pass the implementation to the builder of the resolver:
+//
+//	m, err := otelmetrics.New(otel.GetMeterProvider())
+//	if err != nil {
+//		return err
+//	}
+//	resolver.Register(consul.NewBuilder(consul.WithMetrics(m)))
+//
+// The metrics can be exported to Prometheus with the OpenTelemetry Prometheus
+// exporter.
+// All metrics have the attributes consul.service and consul.datacenter.
+package otelmetrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/simplesurance/grpcconsulresolver/consul"
+)
+
+const meterName = "github.com/simplesurance/grpcconsulresolver"
+
+// Attribute keys of the recorded metrics.
+const (
+	ServiceKey    = attribute.Key("consul.service")
+	DatacenterKey = attribute.Key("consul.datacenter")
+	ErrorTypeKey  = attribute.Key("error.type")
+	UpdateKey     = attribute.Key("update.kind")
+)
+
+// Metrics is a [consul.Metrics] implementation that records the metrics via
+// OpenTelemetry instruments.
+type Metrics struct {
+	queries          metric.Int64Counter
+	queryDuration    metric.Float64Histogram
+	queryErrors      metric.Int64Counter
+	retries          metric.Int64Gauge
+	addresses        metric.Int64Gauge
+	updates          metric.Int64Counter
+	waitIndexResets  metric.Int64Counter
+	tooFastResponses metric.Int64Counter
+}
+
+var _ consul.Metrics = (*Metrics)(nil)
+
+// New creates the instruments with a meter of mp.
+func New(mp metric.MeterProvider) (*Metrics, error) {
+	meter := mp.Meter(meterName)
+
+	var m Metrics
+	var err error
+	var errs []error
+
+	m.queries, err = meter.Int64Counter(
+		"grpcconsulresolver.queries",
+		metric.WithDescription("Number of queries for the instances of a service."),
+		metric.WithUnit("{query}"),
+	)
+	errs = append(errs, err)
+
+	m.queryDuration, err = meter.Float64Histogram(
+		"grpcconsulresolver.query.duration",
+		metric.WithDescription("Duration of queries for the instances of a service, including the time blocking queries waited for changes."),
+		metric.WithUnit("s"),
+	)
+	errs = append(errs, err)
+
+	m.queryErrors, err = meter.Int64Counter(
+		"grpcconsulresolver.query.errors",
+		metric.WithDescription("Number of failed queries for the instances of a service."),
+		metric.WithUnit("{error}"),
+	)
+	errs = append(errs, err)
+
+	m.retries, err = meter.Int64Gauge(
+		"grpcconsulresolver.retries",
+		metric.WithDescription("Number of consecutive failed queries for the instances of a service."),
+		metric.WithUnit("{retry}"),
+	)
+	errs = append(errs, err)
+
+	m.addresses, err = meter.Int64Gauge(
+		"grpcconsulresolver.addresses",
+		metric.WithDescription("Number of addresses that were reported to gRPC for a resolver target."),
+		metric.WithUnit("{address}"),
+	)
+	errs = append(errs, err)
+
+	m.updates, err = meter.Int64Counter(
+		"grpcconsulresolver.updates",
+		metric.WithDescription("Number of states and errors reported to gRPC for a resolver target."),
+		metric.WithUnit("{update}"),
+	)
+	errs = append(errs, err)
+
+	m.waitIndexResets, err = meter.Int64Counter(
+		"grpcconsulresolver.waitindex.resets",
+		metric.WithDescription("Number of times Consul responded with a smaller index and the blocking query loop was restarted."),
+		metric.WithUnit("{reset}"),
+	)
+	errs = append(errs, err)
+
+	m.tooFastResponses, err = meter.Int64Counter(
+		"grpcconsulresolver.too_fast_responses",
+		metric.WithDescription("Number of times Consul responded too fast with unchanged data and the next query was delayed."),
+		metric.WithUnit("{response}"),
+	)
+	errs = append(errs, err)
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+func attrs(l consul.Labels, kv ...attribute.KeyValue) metric.MeasurementOption {
+	return metric.WithAttributes(append(
+		[]attribute.KeyValue{ServiceKey.String(l.Service), DatacenterKey.String(l.Datacenter)},
+		kv...,
+	)...)
+}
+
+func (m *Metrics) QueryDone(l consul.Labels, latency time.Duration, errType consul.ErrorType) {
+	ctx := context.Background()
+
+	m.queries.Add(ctx, 1, attrs(l))
+	m.queryDuration.Record(ctx, latency.Seconds(), attrs(l))
+
+	if errType != consul.ErrorTypeNone {
+		m.queryErrors.Add(ctx, 1, attrs(l, ErrorTypeKey.String(string(errType))))
+	}
+}
+
+func (m *Metrics) RetryCount(l consul.Labels, retries int) {
+	m.retries.Record(context.Background(), int64(retries), attrs(l))
+}
+
+func (m *Metrics) StateReported(l consul.Labels, addresses int) {
+	ctx := context.Background()
+
+	m.updates.Add(ctx, 1, attrs(l, UpdateKey.String("state")))
+	m.addresses.Record(ctx, int64(addresses), attrs(l))
+}
+
+func (m *Metrics) ErrorReported(l consul.Labels) {
+	m.updates.Add(context.Background(), 1, attrs(l, UpdateKey.String("error")))
+}
+
+func (m *Metrics) WaitIndexReset(l consul.Labels) {
+	m.waitIndexResets.Add(context.Background(), 1, attrs(l))
+}
+
+func (m *Metrics) TooFastResponse(l consul.Labels) {
+	m.tooFastResponses.Add(context.Background(), 1, attrs(l))
+}
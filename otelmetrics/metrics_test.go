@@ -0,0 +1,77 @@
+package otelmetrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/simplesurance/grpcconsulresolver/consul"
+)
+
+func collect(t *testing.T, reader *sdkmetric.ManualReader) map[string]metricdata.Aggregation {
+	t.Helper()
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal("collecting metrics failed:", err)
+	}
+
+	result := map[string]metricdata.Aggregation{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			result[m.Name] = m.Data
+		}
+	}
+
+	return result
+}
+
+func TestMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	m, err := New(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	if err != nil {
+		t.Fatal("New() failed:", err)
+	}
+
+	l := consul.Labels{Service: "user-service", Datacenter: "dc2"}
+
+	m.QueryDone(l, 100*time.Millisecond, consul.ErrorTypeNone)
+	m.QueryDone(l, time.Second, consul.ErrorTypeTimeout)
+	m.RetryCount(l, 1)
+	m.StateReported(l, 3)
+	m.ErrorReported(l)
+
+	metrics := collect(t, reader)
+
+	queries, ok := metrics["grpcconsulresolver.queries"].(metricdata.Sum[int64])
+	if !ok || len(queries.DataPoints) != 1 || queries.DataPoints[0].Value != 2 {
+		t.Errorf("unexpected queries metric: %+v", metrics["grpcconsulresolver.queries"])
+	} else {
+		want := attribute.NewSet(ServiceKey.String("user-service"), DatacenterKey.String("dc2"))
+		if !queries.DataPoints[0].Attributes.Equals(&want) {
+			t.Errorf("queries metric has attributes %v, expected %v", queries.DataPoints[0].Attributes, want)
+		}
+	}
+
+	queryErrors, ok := metrics["grpcconsulresolver.query.errors"].(metricdata.Sum[int64])
+	if !ok || len(queryErrors.DataPoints) != 1 {
+		t.Fatalf("unexpected query.errors metric: %+v", metrics["grpcconsulresolver.query.errors"])
+	}
+	if v, _ := queryErrors.DataPoints[0].Attributes.Value(ErrorTypeKey); v.AsString() != "timeout" {
+		t.Errorf("query error has error.type %q, expected timeout", v.AsString())
+	}
+
+	addresses, ok := metrics["grpcconsulresolver.addresses"].(metricdata.Gauge[int64])
+	if !ok || len(addresses.DataPoints) != 1 || addresses.DataPoints[0].Value != 3 {
+		t.Errorf("unexpected addresses metric: %+v", metrics["grpcconsulresolver.addresses"])
+	}
+
+	updates, ok := metrics["grpcconsulresolver.updates"].(metricdata.Sum[int64])
+	if !ok || len(updates.DataPoints) != 2 {
+		t.Errorf("unexpected updates metric: %+v", metrics["grpcconsulresolver.updates"])
+	}
+}